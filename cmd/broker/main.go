@@ -1,28 +1,37 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
-	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/c12o16h1/shender/pkg/broker"
 	"github.com/c12o16h1/shender/pkg/cache"
 	"github.com/c12o16h1/shender/pkg/config"
 	"github.com/c12o16h1/shender/pkg/models"
+	"github.com/c12o16h1/shender/pkg/processor"
+	"github.com/c12o16h1/shender/pkg/render"
 	"github.com/c12o16h1/shender/pkg/webserver"
-	"github.com/gorilla/websocket"
 )
 
 var (
 	shortSleeper = 1 * time.Second
 	)
 
+const (
+	ERR_INVALID_RENDER_MODE = models.Error("Invalid render mode")
+	ERR_NO_REMOTE_URL       = models.Error("Remote render mode requires RENDER_REMOTE_URL")
+)
+
 func main() {
 	// Initialization
 	cfg := config.New()
-	appID := "qwerty" // TODO move to config
 	// Create new Cacher connection
 	cacher, err := cache.New(cfg.Cache)
 	if err != nil {
@@ -30,23 +39,69 @@ func main() {
 	}
 	defer cacher.Close()
 
+	// Create sanitizer and post-processing chain for pages received from network
+	sanitizer := processor.NewSanitizer(cfg.App.Hosts, cfg.App.TrustedHosts, cfg.App.MaxPageSize)
+	if len(cfg.App.Hosts) == 0 {
+		log.Print("APP_HOSTS is empty, pages rendered by peers are rejected")
+	}
+	verifier := broker.NewVerifier(cfg.App.Replicas, cfg.App.Quorum)
+	chain, err := processor.New(cfg.App.PostProcess, cfg.App.MaxPageSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Key to sign pages rendered by this app, and keys of peers to check their pages
+	key, err := broker.LoadKey(cfg.App.KeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyring := broker.NewKeyring(cacher, cfg.App.BannedPeers)
+	// Render credits earned and spent by this app
+	ledger, err := broker.NewLedger(cacher, cfg.App.ID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Create renderer of pages for other members of system
+	renderer, closeRenderer, err := newRenderer(cfg.Render)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer closeRenderer()
+
 	// Create new fileserver
 	// Handler to serve files (common case)
 	fsHandler := http.FileServer(http.Dir(cfg.Main.Dir))
 
 	// Setup renderer queues
 	// Incoming queue is a queue for incoming Jobs,
-	// It have limited capacity and contain Jobs to process
-	// In case of channel is full client app will send "busy" signal to server
-	incomingQueue := make(chan models.Job, cfg.Main.IncomingQueueLimit)
+	// It have limited capacity and contain Jobs to process, most urgent first
+	// In case of queue is full client app will send "busy" signal to server
+	incomingQueue := broker.NewJobQueue(cfg.Main.IncomingQueueLimit)
 
 	// Outgoing queue is queue of result of Jobs (rendered pages sources)
-	// It has some capacity, but it should not hit that limit ever,
-	// Limit exists only for emergency cases and to do not overflow memory limits
-	outgoingQueue := make(chan models.JobResult, cfg.Main.OutgoingQueueLimit)
+	// It's stored on disk, so results survive restarts and disconnects,
+	// and result is removed only once server accepted it
+	outgoingQueue, err := cache.NewQueue(cacher, "results", cfg.Main.OutgoingQueueLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// Queue for passing cache from websocket listener to cache DB
-	storagerQueue := make(chan models.DataResponseCachedPage, cfg.Main.IncomingQueueLimit)
+	// Queue for passing cache from websocket listener to cache DB,
+	// page is removed once it's stored
+	storagerQueue, err := cache.NewQueue(cacher, "storage", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// State of URLs of this app enqueued to be rendered by network,
+	// so every URL is enqueued once until it's cached, failed or stuck
+	tracker := cache.NewTracker(cacher)
+
+	// URLs which were sent to server before restart, but not accepted, are enqueued again
+	if err := broker.RecoverEnqueued(cacher); err != nil {
+		log.Fatal(err)
+	}
 
 	// Sleeper channels to pause in execution in some routines in case of error
 	// Chan to pause request to get new urls for crawling
@@ -57,42 +112,37 @@ func main() {
 	sleeperTypeRequestSendURL := make(chan time.Duration, 1)
 	// Chan to pause request to get cached pages from server
 	sleeperRequestCachedPage := make(chan time.Duration, 1)
-
-	// Service channels
-	// Channel to trigger renew of websockets
-	renewWebsockets := make(chan int, 1)
+	// Chan to pause request to get cached pages while they can't be stored
+	sleeperStorage := make(chan time.Duration, 1)
 
 	/*
 	Establishing WS connection to main server
 	 */
 
-	// Service
-
-	// Create/renew websockets connection
-	var wsc *models.WSConn
-	defer wsc.Close()
-	u := url.URL{Scheme: "ws", Host: cfg.Main.WSHost, Path: ""}
+	// Create/renew websockets connection,
+	// server accepts only authenticated apps
+	if cfg.App.Secret == "" && cfg.App.Token == "" {
+		log.Fatal(broker.ERR_NO_CREDENTIALS)
+	}
+	manager := broker.NewConnManager(func() (*models.WSConn, error) {
+		return broker.Dial(cfg.Main, cfg.App)
+	})
+	defer manager.Close()
+	go manager.Run()
+	// Messages which have to be acknowledged by server, they survive reconnects
+	outbox := broker.NewOutbox()
+	// Server notifies when it has URLs or cached pages, so they aren't polled constantly
+	notifier := broker.NewNotifier()
+	// Log changes of connection state
 	go func() {
-		for {
-			<-renewWebsockets
-			oldConn := wsc
-			if oldConn != nil {
-				oldConn.Close()
-			}
-			wsc = nil
-			ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
-			if err != nil {
-				log.Print("dial:", err)
-				time.Sleep(1 * time.Second)
-				// try again
-				renewWebsockets <- 0
+		for e := range manager.Subscribe() {
+			if e.Err != nil {
+				log.Printf("ws: %s: %s", e.State, e.Err)
 				continue
 			}
-			wsc = models.NewWSConn(ws)
+			log.Printf("ws: %s", e.State)
 		}
 	}()
-	// Intially create websockets conn
-	renewWebsockets <- 0
 
 	// Processing
 
@@ -109,41 +159,47 @@ func main() {
 	*/
 	go func() {
 		for {
-			// Wait and go next loop if ws is unhealthy
-			if wsc == nil {
-				time.Sleep(1 * time.Second)
-				log.Print("wsc is nil")
-				continue
+			// Wait for healthy connection
+			wsc, err := manager.Conn()
+			if err != nil {
+				return
 			}
 			if err := broker.Listen(
 				wsc,
 				incomingQueue,
 				storagerQueue,
+				keyring,
+				outbox,
+				notifier,
+				ledger,
+				tracker,
 				sleeperRequestGetUrls,
 				sleeperResponseCachedPage,
 				sleeperTypeRequestSendURL,
 				sleeperRequestCachedPage,
 			); err != nil {
 				log.Print(err)
+				// Session is revoked, reconnect with fresh handshake
+				if err == broker.ERR_AUTH_REJECTED {
+					manager.Drop(wsc)
+				}
 				time.Sleep(shortSleeper)
 			}
 		}
 	}()
 
-	// Other Apps pages crawling
 	/*
-	Spawn goroutine to get URLs for crawling from server
-	so they'll be crawled by this app.
+	Spawn goroutine to register key of this app on server,
+	and to ask server for keys of peers
 	*/
 	go func() {
 		for {
-			// Wait and go next loop if ws is unhealthy
-			if wsc == nil {
-				time.Sleep(1 * time.Second)
-				log.Print("wsc is nil")
-				continue
+			// Wait for healthy connection
+			wsc, err := manager.Conn()
+			if err != nil {
+				return
 			}
-			if err := broker.Request(wsc, incomingQueue, sleeperRequestGetUrls); err != nil {
+			if err := broker.SyncKeys(wsc, cfg.App.ID, key, keyring); err != nil {
 				log.Print(err)
 				time.Sleep(shortSleeper)
 			}
@@ -151,32 +207,85 @@ func main() {
 	}()
 
 	/*
-	Spawn goroutine to process crawling of pages for other members of system.
-	This goroutine ensure that server has enough resources to do render,
-	spawn new renderer instance, connect to them via RPC, and do render for URL from incoming queue.
-	Then save push result to outgoing queue
-	 */
+	Spawn goroutine to ask server for balance of render credits
+	*/
 	go func() {
 		for {
-			if err := broker.Crawl(incomingQueue, outgoingQueue); err != nil {
-				log.Print("Crawl: ", err)
+			// Wait for healthy connection
+			wsc, err := manager.Conn()
+			if err != nil {
+				return
+			}
+			if err := ledger.Sync(wsc, cfg.App.ID); err != nil {
+				log.Print(err)
 				time.Sleep(shortSleeper)
 			}
 		}
 	}()
 
+	/*
+	Spawn goroutine to resend messages which server didn't acknowledge
+	*/
+	go func() {
+		for {
+			// Wait for healthy connection
+			wsc, err := manager.Conn()
+			if err != nil {
+				return
+			}
+			if err := outbox.Redeliver(wsc); err != nil {
+				log.Print(err)
+			}
+			time.Sleep(shortSleeper)
+		}
+	}()
+
+	// Other Apps pages crawling
+	/*
+	Spawn goroutine to get URLs for crawling from server
+	so they'll be crawled by this app.
+	*/
+	go func() {
+		for {
+			// Wait for healthy connection
+			wsc, err := manager.Conn()
+			if err != nil {
+				return
+			}
+			if err := broker.Request(wsc, incomingQueue, notifier, sleeperRequestGetUrls); err != nil {
+				log.Print(err)
+				time.Sleep(shortSleeper)
+			}
+		}
+	}()
+
+	/*
+	Spawn goroutines to process crawling of pages for other members of system.
+	They ensure that server has enough resources to do render,
+	and do render for URL from incoming queue with configured renderer.
+	Then save push result to outgoing queue.
+	On shutdown jobs in progress are finished, so their results aren't lost
+	 */
+	ctx, stopCrawl := context.WithCancel(context.Background())
+	defer stopCrawl()
+	crawler := broker.NewCrawler(renderer, cfg.Render.Timeout, incomingQueue, outgoingQueue, broker.MAX_RENDERERS)
+	crawled := make(chan struct{})
+	go func() {
+		crawler.Run(ctx)
+		close(crawled)
+	}()
+
 	/*
 	Spawn goroutine to push content of crawled pages to server
 	*/
 	go func() {
 		for {
-			// Wait and go next loop if ws is unhealthy
-			if wsc == nil {
-				time.Sleep(1 * time.Second)
-				log.Print("wsc is nil")
-				continue
+			// Wait for healthy connection
+			wsc, err := manager.Conn()
+			if err != nil {
+				return
 			}
-			if err := broker.Push(wsc, outgoingQueue, sleeperResponseCachedPage); err != nil {
+			if err := broker.Push(wsc, outbox, ledger, cfg.App.ID, key, outgoingQueue, sleeperResponseCachedPage); err != nil {
 				log.Print(err)
 				time.Sleep(shortSleeper)
 			}
@@ -190,32 +299,63 @@ func main() {
 	*/
 	go func() {
 		for {
-			// Wait and go next loop if ws is unhealthy
-			if wsc == nil {
-				time.Sleep(1 * time.Second)
-				log.Print("wsc is nil")
-				continue
+			// Wait for healthy connection
+			wsc, err := manager.Conn()
+			if err != nil {
+				return
 			}
-			if err := broker.Enqueue(&cacher, wsc, appID, sleeperTypeRequestSendURL); err != nil {
+			if err := broker.Enqueue(&cacher, tracker, wsc, outbox, cfg.App, sleeperTypeRequestSendURL); err != nil {
 				log.Print(err)
 				time.Sleep(shortSleeper)
 			}
 		}
 	}()
 
+	/*
+	Spawn goroutine to enqueue again URLs which got stuck on server or peer
+	*/
+	go func() {
+		for {
+			n, err := tracker.Reap()
+			if err != nil {
+				log.Print(err)
+			} else if n > 0 {
+				log.Printf("Enqueued again %d stuck URLs", n)
+			}
+			time.Sleep(cache.TRACK_REAP_PERIOD)
+		}
+	}()
+
+	/*
+	Spawn goroutine to warm cache with pages from sitemap,
+	they're rendered after pages requested by bots
+	*/
+	if cfg.Main.Sitemap != "" {
+		go func() {
+			for {
+				n, err := webserver.Warm(cacher, tracker, cfg.Main.Sitemap)
+				if err != nil {
+					log.Print(err)
+				} else if n > 0 {
+					log.Printf("Enqueued %d pages from sitemap", n)
+				}
+				time.Sleep(webserver.SITEMAP_WARM_PERIOD)
+			}
+		}()
+	}
+
 	/*
 	Spawn goroutine to get cached pages from central server
 	so bots may see cached pages content
 	*/
 	go func() {
 		for {
-			// Wait and go next loop if ws is unhealthy
-			if wsc == nil {
-				time.Sleep(1 * time.Second)
-				log.Print("wsc is nil")
-				continue
+			// Wait for healthy connection
+			wsc, err := manager.Conn()
+			if err != nil {
+				return
 			}
-			if err := broker.RequestCache(wsc, appID, sleeperRequestCachedPage, renewWebsockets); err != nil {
+			if err := broker.RequestCache(wsc, cfg.App.ID, notifier, sleeperRequestCachedPage, sleeperStorage); err != nil {
 				log.Print(err)
 				time.Sleep(shortSleeper)
 			}
@@ -228,7 +368,7 @@ func main() {
 	*/
 	go func() {
 		for {
-			if err := broker.Storage(&cacher, storagerQueue, sleeperRequestCachedPage); err != nil {
+			if err := broker.Storage(&cacher, keyring, ledger, tracker, sanitizer, verifier, chain, storagerQueue, sleeperStorage); err != nil {
 				log.Print(err)
 				time.Sleep(shortSleeper)
 			}
@@ -248,12 +388,68 @@ func main() {
 	If this process cause any error - we have panic and recover procedure
 	 */
 	// TODO: handle Panic by recover
-	if err := serve(cfg.Main, cacher, fsHandler); err != nil {
-		log.Panic(err)
+	go func() {
+		if err := serve(cfg.Main, cacher, tracker, fsHandler); err != nil {
+			log.Panic(err)
+		}
+	}()
+	// Counters and balance are served on separate listener, so they aren't public
+	if cfg.Main.DebugAddr != "" {
+		go func() {
+			if err := serveDebug(cfg.Main, cacher); err != nil {
+				log.Print(err)
+			}
+		}()
 	}
+
+	// Wait for jobs in progress on shutdown, then close workers and cache
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	log.Print("Shutting down, finishing jobs in progress")
+	stopCrawl()
+	<-crawled
+}
+
+/*
+Renderer according to render mode and func to close it:
+worker process spawned via supervisor for every page, Chrome launched by broker itself,
+or remote Chrome via its DevTools endpoint.
+ */
+func newRenderer(cfg *config.RenderConfig) (models.Renderer, func(), error) {
+	switch cfg.Mode {
+	case config.RENDER_MODE_CHROME:
+		chrome, err := render.NewChrome(cfg, cfg.ChromePort, cfg.ChromePort+render.CHROME_PORTS)
+		if err != nil {
+			return nil, nil, err
+		}
+		return chrome, chrome.Close, nil
+	case config.RENDER_MODE_REMOTE:
+		if cfg.RemoteURL == "" {
+			return nil, nil, ERR_NO_REMOTE_URL
+		}
+		return render.NewRemote(cfg.RemoteURL), func() {}, nil
+	case config.RENDER_MODE_RPC:
+		// Supervisor reaps crashed workers and kills hung ones
+		supervisor := broker.NewSupervisor(cfg)
+		go supervisor.Watch()
+		return supervisor, supervisor.Shutdown, nil
+	}
+	return nil, nil, ERR_INVALID_RENDER_MODE
+}
+
+func serve(config *config.MainConfig, cacher cache.Cacher, tracker *cache.Tracker, fsHandler http.Handler) error {
+	// Own mux, so expvar registered on default one isn't public
+	mux := http.NewServeMux()
+	mux.Handle("/", webserver.PickHandler(cacher, tracker, fsHandler))
+	mux.Handle(webserver.PATH_SCREENSHOT, webserver.SnapshotHandler(cacher, models.PREFIX_SCREENSHOT, webserver.CONTENT_TYPE_PNG))
+	mux.Handle(webserver.PATH_PDF, webserver.SnapshotHandler(cacher, models.PREFIX_PDF, webserver.CONTENT_TYPE_PDF))
+	return http.ListenAndServe(fmt.Sprintf(":%d", config.Port), mux)
 }
 
-func serve(config *config.MainConfig, cacher cache.Cacher, fsHandler http.Handler) error {
-	http.Handle("/", webserver.PickHandler(cacher, fsHandler))
-	return http.ListenAndServe(fmt.Sprintf(":%d", config.Port), nil)
+func serveDebug(config *config.MainConfig, cacher cache.Cacher) error {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle(webserver.PATH_BALANCE, webserver.BalanceHandler(cacher))
+	return http.ListenAndServe(config.DebugAddr, mux)
 }
@@ -12,36 +12,55 @@ import (
 )
 
 const (
-	WORKER_LIFE_TIME = 30 * time.Second
+	WORKER_LIFE_TIME = 30 * time.Second // Default, broker sets it according to render timeout
 
-	ERR_INVALID_PORT = models.Error("Invalid port")
+	ERR_INVALID_NETWORK = models.Error("Invalid network")
 )
 
 func main() {
-	port := flag.Int("port", 0, "this binary port")
+	network := flag.String("network", "tcp", "network to listen: tcp or unix")
+	addr := flag.String("addr", "127.0.0.1:0", "address to listen, port 0 picks free port")
+	lifetime := flag.Duration("lifetime", WORKER_LIFE_TIME, "worker exits after this time")
+	chrome := registerChromeFlags()
 	flag.Parse()
-	if *port == 0 {
-		log.Fatal(ERR_INVALID_PORT)
+	if *network != "tcp" && *network != "unix" {
+		log.Fatal(ERR_INVALID_NETWORK)
+	}
+	cfg, err := chrome.config()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	w, _ := NewWorker(*port - 10000, *port - 9999)
+	w := NewWorker(cfg)
 	// Close worker anyway if after some time
 	go func() {
-		time.Sleep(WORKER_LIFE_TIME)
+		time.Sleep(*lifetime)
 		var out string
 		w.Close(0, &out)
 	}()
 	rpc.Register(w)
-	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", *port))
+	ln, err := net.Listen(*network, *addr)
 	if err != nil {
-		fmt.Println(err)
-		return
+		log.Fatal(err)
 	}
+	// Stdout is reserved for handshake, broker waits for this line to connect
+	fmt.Printf("%s %s %s\n", models.RENDER_LISTEN, ln.Addr().Network(), ln.Addr().String())
 	for {
 		c, err := ln.Accept()
 		if err != nil {
 			continue
 		}
-		rpc.ServeConn(c)
+		go rpc.ServeConn(c)
+	}
+}
+
+// Ask OS for free port for chrome debugging protocol.
+// It's free only at the moment, so someone else may take it before Chrome.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
 	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+
+	"github.com/c12o16h1/shender/pkg/config"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	ERR_INVALID_WINDOW_SIZE = models.Error("Invalid window size")
+)
+
+// Chrome launch options passed by broker
+type chromeFlags struct {
+	bin         *string
+	headless    *bool
+	noSandbox   *bool
+	disableGPU  *bool
+	proxy       *string
+	userDataDir *string
+	windowSize  *string
+	extra       *string
+}
+
+func registerChromeFlags() *chromeFlags {
+	return &chromeFlags{
+		bin:         flag.String("chrome-bin", "", "path to chrome binary, looked up in PATH if empty"),
+		headless:    flag.Bool("headless", true, "run chrome in headless mode"),
+		noSandbox:   flag.Bool("no-sandbox", false, "disable chrome sandbox"),
+		disableGPU:  flag.Bool("disable-gpu", true, "disable chrome GPU process"),
+		proxy:       flag.String("proxy", "", "outbound proxy server"),
+		userDataDir: flag.String("user-data-dir", "", "base dir for chrome profile"),
+		windowSize:  flag.String("window-size", "", "initial window size as width,height"),
+		extra:       flag.String("chrome-flags", "", "extra chrome flags as name=value,name"),
+	}
+}
+
+// Build render config from flags
+func (f *chromeFlags) config() (*config.RenderConfig, error) {
+	cfg := config.RenderConfig{
+		ChromeBin:   *f.bin,
+		Headless:    *f.headless,
+		NoSandbox:   *f.noSandbox,
+		DisableGPU:  *f.disableGPU,
+		Proxy:       *f.proxy,
+		UserDataDir: *f.userDataDir,
+	}
+	if *f.windowSize != "" {
+		size := strings.Split(*f.windowSize, ",")
+		if len(size) != 2 {
+			return nil, ERR_INVALID_WINDOW_SIZE
+		}
+		w, errW := strconv.Atoi(size[0])
+		h, errH := strconv.Atoi(size[1])
+		if errW != nil || errH != nil {
+			return nil, ERR_INVALID_WINDOW_SIZE
+		}
+		cfg.WindowWidth, cfg.WindowHeight = w, h
+	}
+	if *f.extra != "" {
+		cfg.ChromeFlags = strings.Split(*f.extra, ",")
+	}
+	return &cfg, nil
+}
@@ -2,56 +2,90 @@ package main
 
 import (
 	"context"
+	"log"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/c12o16h1/shender/pkg/config"
 	"github.com/c12o16h1/shender/pkg/models"
+	"github.com/c12o16h1/shender/pkg/render"
+)
 
-	"github.com/chromedp/chromedp"
+const (
+	CHROME_PORT_ATTEMPTS = 3 // Ports to try, if free port is taken before Chrome is launched on it
 )
 
-// Worker is a wrapper for headless Chrome instance
+// Worker serves in-process Chrome renderer via RPC
 type Worker struct {
-	models.Renderer
-	worker  *chromedp.Pool
-	context *context.Context
-	cancel  *context.CancelFunc
+	cfg     *config.RenderConfig
 	created time.Time
+
+	mtx    sync.Mutex
+	chrome *render.Chrome // Chrome launched for page, if any
 }
 
 // Spawn new worker instance
-func NewWorker(start int, end int) (*Worker, error) {
-	ctxt, cancel := context.WithCancel(context.Background())
-	c, err := chromedp.NewPool(chromedp.PortRange(start, end))
-	if err != nil {
-		return nil, err
-	}
-
-	w := Worker{
-		worker:  c,
-		context: &ctxt,
-		cancel:  &cancel,
+func NewWorker(cfg *config.RenderConfig) *Worker {
+	return &Worker{
+		cfg:     cfg,
 		created: time.Now(),
 	}
-	return &w, nil
 }
 
 // Very basic worker function to get page source
 func (w *Worker) Close(sig int, out *string) error {
-	w.worker.Shutdown()
+	w.mtx.Lock()
+	if w.chrome != nil {
+		w.chrome.Close()
+	}
+	w.mtx.Unlock()
 	os.Exit(sig)
 	return nil
 }
 
-// Very basic worker function to get page source
-func (w *Worker) Render(url string, html *string) error {
-	c, err := w.worker.Allocate(*w.context)
+// Render page in Chrome on free debugging port.
+// Port may be taken by someone else before Chrome is launched, then another one is tried.
+func (w *Worker) Render(req models.RenderRequest, res *models.RenderResult) error {
+	var err error
+	for i := 0; i < CHROME_PORT_ATTEMPTS; i++ {
+		var c *render.Chrome
+		if c, err = w.launch(); err != nil {
+			return err
+		}
+		var r models.RenderResult
+		r, err = c.Render(context.Background(), req)
+		if err == render.ERR_CHROME_PORT {
+			log.Print("Render: ", err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		*res = r
+		return nil
+	}
+	return err
+}
+
+// Chrome on new free port, previous one is closed
+func (w *Worker) launch() (*render.Chrome, error) {
+	port, err := freePort()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer c.Release()
-	c.Run(*w.context, renderTasks(url, html))
-	return nil
+	// End of range is exclusive, so Chrome uses only this port
+	c, err := render.NewChrome(w.cfg, port, port+1)
+	if err != nil {
+		return nil, err
+	}
+	w.mtx.Lock()
+	if w.chrome != nil {
+		w.chrome.Close()
+	}
+	w.chrome = c
+	w.mtx.Unlock()
+	return c, nil
 }
 
 // Check that worker is alive
@@ -59,11 +93,3 @@ func (w *Worker) Heartbeat(in string, out *string) error {
 	*out = models.OK
 	return nil
 }
-
-func renderTasks(url string, body *string) chromedp.Tasks {
-	return chromedp.Tasks{
-		chromedp.Navigate(url),
-		chromedp.Sleep(2 * time.Second),
-		chromedp.InnerHTML("html", body),
-	}
-}
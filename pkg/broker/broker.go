@@ -1,8 +1,28 @@
 package broker
 
-import "time"
+import (
+	"time"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+// Version of broker, set at build time with -ldflags "-X github.com/c12o16h1/shender/pkg/broker.Version=..."
+var Version = "dev"
+
+// Wait for notification of server, or for poll timeout
+func waitNotify(conn *models.WSConn, ch <-chan struct{}) {
+	select {
+	case <-ch:
+	case <-time.After(WS_POLL_TIMEOUT):
+	case <-conn.Done():
+	}
+}
 
 const (
 	WS_BUMP_TIMEOUT  = 1000 * time.Millisecond // Default timeout to bump server with requests
 	WS_ERROR_TIMEOUT = 60 * time.Second        // Default timeout to pause requests on error from server
+	WS_POLL_TIMEOUT  = 30 * time.Second        // Servers with notifications are still polled, in case notification is lost
+
+	CACHE_BATCH_SIZE   = 20 // Max amount of cached pages in one response
+	ENQUEUE_BATCH_SIZE = 50 // Max amount of URLs sent to enqueue in one message
 )
@@ -0,0 +1,211 @@
+package broker
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	WS_BACKOFF_MIN    = 1 * time.Second // First pause before reconnect
+	WS_BACKOFF_MAX    = 2 * time.Minute // Pause before reconnect grows up to this limit
+	WS_BACKOFF_FACTOR = 2
+
+	CONN_EVENTS_LIMIT = 10 // Buffer of events for every subscriber, slow ones miss events
+
+	ERR_MANAGER_CLOSED = models.Error("Connection manager is closed")
+)
+
+// State of connection to server
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting
+	StateConnected
+	StateRejected // Server rejected credentials
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateRejected:
+		return "rejected"
+	}
+	return "disconnected"
+}
+
+// Change of connection state, Err is reason of disconnect
+type ConnEvent struct {
+	State ConnState
+	Err   error
+	Time  time.Time
+}
+
+/*
+ConnManager owns websocket connection to server.
+It connects with backoff, keeps connection alive with pings,
+and reconnects when connection is broken.
+Routines get current connection with Conn.
+*/
+type ConnManager struct {
+	dial func() (*models.WSConn, error)
+
+	mtx    sync.Mutex
+	cond   *sync.Cond
+	conn   *models.WSConn
+	state  ConnState
+	closed bool
+	subs   []chan ConnEvent
+
+	stop chan struct{}
+}
+
+// Create manager, dial is called for every connection attempt
+func NewConnManager(dial func() (*models.WSConn, error)) *ConnManager {
+	m := ConnManager{
+		dial: dial,
+		stop: make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mtx)
+	return &m
+}
+
+// Run connects to server and reconnects until manager is closed
+func (m *ConnManager) Run() {
+	backoff := WS_BACKOFF_MIN
+	for {
+		m.setState(StateConnecting, nil, nil)
+		conn, err := m.dial()
+		if err != nil {
+			pause := jitter(backoff)
+			// Don't hammer server with invalid credentials
+			if errors.Cause(err) == ERR_AUTH_REJECTED {
+				m.setState(StateRejected, nil, err)
+				pause = WS_AUTH_RETRY_TIMEOUT
+			} else {
+				m.setState(StateDisconnected, nil, err)
+			}
+			backoff = nextBackoff(backoff)
+			select {
+			case <-time.After(pause):
+				continue
+			case <-m.stop:
+				return
+			}
+		}
+		backoff = WS_BACKOFF_MIN
+
+		m.setState(StateConnected, conn, nil)
+		err = m.keepalive(conn)
+		m.setState(StateDisconnected, nil, err)
+		if err == ERR_MANAGER_CLOSED {
+			return
+		}
+	}
+}
+
+// Ping server until connection is closed
+func (m *ConnManager) keepalive(conn *models.WSConn) error {
+	t := time.NewTicker(models.WS_PING_PERIOD)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := conn.Ping(); err != nil {
+				return errors.Wrap(err, "keepalive: ping:")
+			}
+		case <-conn.Done():
+			return nil
+		case <-m.stop:
+			conn.Close()
+			return ERR_MANAGER_CLOSED
+		}
+	}
+}
+
+// Conn waits for connection to server
+func (m *ConnManager) Conn() (*models.WSConn, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	for m.conn == nil && !m.closed {
+		m.cond.Wait()
+	}
+	if m.closed {
+		return nil, ERR_MANAGER_CLOSED
+	}
+	return m.conn, nil
+}
+
+// Drop broken connection, so manager reconnects.
+// Connection is closed anyway, f.e. when session is revoked by server.
+func (m *ConnManager) Drop(conn *models.WSConn) {
+	conn.Close()
+}
+
+// Subscribe to changes of connection state
+func (m *ConnManager) Subscribe() <-chan ConnEvent {
+	ch := make(chan ConnEvent, CONN_EVENTS_LIMIT)
+	m.mtx.Lock()
+	m.subs = append(m.subs, ch)
+	m.mtx.Unlock()
+	return ch
+}
+
+// State of connection
+func (m *ConnManager) State() ConnState {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.state
+}
+
+// Close connection and stop reconnecting
+func (m *ConnManager) Close() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.closed {
+		return
+	}
+	m.closed = true
+	close(m.stop)
+	m.cond.Broadcast()
+}
+
+// Set state and notify waiters and subscribers
+func (m *ConnManager) setState(s ConnState, conn *models.WSConn, err error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.state = s
+	m.conn = conn
+	if conn != nil {
+		m.cond.Broadcast()
+	}
+	e := ConnEvent{State: s, Err: err, Time: time.Now()}
+	for _, ch := range m.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Random pause in [d/2, d), so brokers don't reconnect all at once after server restart
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// Next backoff, up to limit
+func nextBackoff(d time.Duration) time.Duration {
+	d *= WS_BACKOFF_FACTOR
+	if d > WS_BACKOFF_MAX {
+		d = WS_BACKOFF_MAX
+	}
+	return d
+}
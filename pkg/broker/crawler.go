@@ -1,18 +1,16 @@
 package broker
 
 import (
-	"bytes"
-	"fmt"
+	"context"
+	"encoding/json"
 	"log"
-	"net"
-	"net/rpc"
-	"os/exec"
 	"sync"
 	"time"
 
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/mem"
 
+	"github.com/c12o16h1/shender/pkg/cache"
 	"github.com/c12o16h1/shender/pkg/models"
 )
 
@@ -22,100 +20,184 @@ const (
 
 	MAIN_LOOP_TIMEOUT = 10 * time.Millisecond // Timeout in main process loop to let CPU do more important things
 
-	MAX_RENDERERS = 10 // Max amount of alive workers
+	MAX_RENDERERS = 10 // Max amount of pages rendered at once
 
-	// Port range to run renderer workers
-	MIN_RENDEDER_PORT int = 52500
-	MAX_RENDEDER_PORT int = 57750
+	JOB_MAX_ATTEMPTS = 3                // Failed job is rendered this many times, then failure is reported
+	JOB_RETRY_MIN    = 10 * time.Second // Pause before first retry, it doubles with every attempt
+	JOB_RETRY_MAX    = 5 * time.Minute  // Pause before retry grows up to this limit
 
 	ERR_INVALID_WORKER = models.Error("Invalid worker")
 )
 
-var (
-	busyPorts = make(map[int]bool)
-	port      = MIN_RENDEDER_PORT
-)
-
 /*
-Crawler crawl websites pages and get cache from them
+Crawler is a pool of goroutines which take jobs from queue,
+render pages with renderer, and store results.
+Once context is done, no new jobs are taken, jobs in progress are finished
+and their results stored before Run returns.
  */
-func Crawl(chJobs <-chan models.Job, chRes chan<- models.JobResult) error {
+type Crawler struct {
+	renderer models.Renderer
+	timeout  time.Duration // Max time to render one page
+	jobs     *JobQueue
+	results  *cache.Queue
+	workers  int
+
+	ready func() bool // Whether there are resources to start next job
+}
+
+func NewCrawler(renderer models.Renderer, timeout time.Duration, jobs *JobQueue, results *cache.Queue, workers int) *Crawler {
+	c := &Crawler{
+		renderer: renderer,
+		timeout:  timeout,
+		jobs:     jobs,
+		results:  results,
+		workers:  workers,
+		ready:    enoughResources,
+	}
+	jobs.OnExpired(c.expired)
+	return c
+}
+
+// Run crawls until context is done, then waits for jobs in progress
+func (c *Crawler) Run(ctx context.Context) {
 	var wg sync.WaitGroup
-	var mtx sync.Mutex
-	limiter := make(chan struct{}, MAX_RENDERERS)
-	go func() {
-		for {
-			//log.Print("LIMITER:", len(limiter), cap(limiter))
-			//log.Print("JOBS:", len(chJobs), cap(chJobs))
-			//log.Print("JOBRES:", len(chRes), cap(chRes))
-			time.Sleep(1 * time.Second)
-		}
-	}()
+	wg.Add(c.workers)
+	for i := 0; i < c.workers; i++ {
+		go func() {
+			defer wg.Done()
+			c.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
 
+// Take jobs one by one until context is done
+func (c *Crawler) work(ctx context.Context) {
 	for {
-		if !enoughResources() {
-			time.Sleep(MAIN_LOOP_TIMEOUT) // Sleep a bit, let CPU do other, more important loops
+		// No job is taken until there are resources for it
+		if !c.ready() {
+			// Sleep a bit, let CPU do other, more important loops
+			select {
+			case <-time.After(MAIN_LOOP_TIMEOUT):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		// Results wait for server, there is no room for new ones
+		for c.results.Full() {
+			select {
+			case <-time.After(cache.QUEUE_POLL_PERIOD):
+			case <-ctx.Done():
+				return
+			}
 		}
-		limiter <- struct{}{}         // would block if we already have enough renderers
-		time.Sleep(MAIN_LOOP_TIMEOUT) // Sleep a bit, let CPU do other, more important loops
-		job := <-chJobs
+		job, err := c.jobs.Pop(ctx) // Most urgent job first
+		if err != nil {
+			return
+		}
+		c.handleJob(job)
+	}
+}
 
-		mtx.Lock()
-		port = nextPort(port)
-		mtx.Unlock()
+// Render page of job and store result, failed job is retried later
+func (c *Crawler) handleJob(j models.Job) {
+	result := doJob(c.renderer, c.timeout, j)
+	log.Print(result.Job.Url, " : ", len(result.HTML))
+	if result.Status == models.JobFailed && retry(c.jobs, result) {
+		return
+	}
+	// Result is stored on disk until server accepts it
+	b, err := json.Marshal(result)
+	if err == nil {
+		err = c.results.Push(b)
+	}
+	if err != nil {
+		log.Print("handleJob: ", err)
+	}
+}
+
+// Job past deadline is reported as failed, so server may reassign or expire it
+func (c *Crawler) expired(j models.Job) {
+	b, err := json.Marshal(models.JobResult{
+		Job:    j,
+		Status: models.JobFailed,
+		Reason: ERR_JOB_EXPIRED.Error(),
+	})
+	if err == nil {
+		err = c.results.Push(b)
+	}
+	if err != nil {
+		log.Print("expired: ", err)
+	}
+}
 
-		go spawnRenderer(port) // lifetime of rendeder is max 30 seconds, so it's safe
-		go handleJob(mtx, wg, job, chRes, port, limiter)
+// Failed job is put back to queue to be rendered after backoff, false if it's given up
+func retry(jobs *JobQueue, result models.JobResult) bool {
+	j := result.Job
+	j.Attempts++
+	notBefore := time.Now().Add(jitter(retryDelay(j.Attempts)))
+	// Retry wouldn't make it before deadline either
+	if j.Attempts >= JOB_MAX_ATTEMPTS || j.Deadline > 0 && notBefore.Unix() >= j.Deadline {
+		log.Print("Job failed: ", j.Url, ": ", result.Reason)
+		metricJobsFailed.Add(1)
+		return false
+	}
+	j.NotBefore = notBefore.Unix()
+	// Queue is full of new jobs, so server gives this one to other peer
+	if !jobs.TryPush(j) {
+		log.Print("Job failed, queue is full: ", j.Url, ": ", result.Reason)
+		metricJobsFailed.Add(1)
+		return false
 	}
-	return nil
+	log.Print("Job retried: ", j.Url, ": ", result.Reason)
+	metricJobsRetried.Add(1)
+	return true
 }
 
-// Goroutine to take job and port for worker, and process them
-func handleJob(mtx sync.Mutex, wg sync.WaitGroup, j models.Job, chRes chan<- models.JobResult, port int, limiter <-chan struct{}) {
-	wg.Add(1)
+// Pause before next attempt of failed job
+func retryDelay(attempts int) time.Duration {
+	d := JOB_RETRY_MIN
+	for i := 1; i < attempts && d < JOB_RETRY_MAX; i++ {
+		d *= 2
+	}
+	if d > JOB_RETRY_MAX {
+		d = JOB_RETRY_MAX
+	}
+	return d
+}
+
+// Render page of job, failure is in result.
+// Job in progress is finished on shutdown, so render isn't bound to crawler context
+func doJob(r models.Renderer, timeout time.Duration, j models.Job) models.JobResult {
 	result := models.JobResult{
 		Status: models.JobFailed,
 		Job:    j,
 	}
-	defer func() {
-		log.Print(port, ":", result.Job.Url, " : ", len(result.HTML))
-		chRes <- result
-		wg.Done()
-		<-limiter // Drain from limiter channel, so allowing to spawn new workers and do other jobs
-		// Free port
-		mtx.Lock()
-		delete(busyPorts, port)
-		mtx.Unlock()
-	}()
-
-	time.Sleep(1 * time.Second) // wait for renderer
-
-	// Create worker for this task
-	c, err := rpc.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
-	if err != nil {
-		log.Print(0, err)
-		return
-	}
-	defer c.Close()
-	// Check that worker is ok
-	var ok string
-	err = c.Call("Worker.Heartbeat", "", &ok)
-	if err != nil || ok != models.OK {
-		log.Print(1, err)
-		return
+	req := models.RenderRequest{
+		URL:     "http://" + j.Url,
+		Device:  j.Device,
+		Options: j.Options,
+		Timeout: timeout,
 	}
-	// Do job
-	url := "http://" + j.Url
-	log.Print("ENQ:", port, ":", url)
-	err = c.Call("Worker.Render", url, &result.HTML)
+	log.Print("ENQ:", req.URL, ":", j.Device.Name)
+	res, err := r.Render(context.Background(), req)
 	if err != nil {
-		log.Print(2, port, err)
-		return
+		log.Print(2, req.URL, err)
+		result.Reason = err.Error()
+		return result
+	}
+	// Empty page is never pushed as cache
+	if res.HTML == "" {
+		result.Reason = models.ERR_EMPTY_RESULT.Error()
+		return result
 	}
-	// Close worker, kill chrome etc
-	c.Call("Worker.Close", 0, nil)
 
+	result.HTML = res.HTML
+	result.Screenshot = res.Screenshot
+	result.PDF = res.PDF
 	result.Status = models.JobOk
+	return result
 }
 
 // Func to check that we have enough CPU and memory to do something,
@@ -137,76 +219,7 @@ func enoughResources() bool {
 	return false
 }
 
-// Round robin algorithm for ports
-func nextPort(current int) int {
-	if current < MIN_RENDEDER_PORT {
-		current = MIN_RENDEDER_PORT
-	}
-	p := current
-
-	for {
-		p += 2
-		if current < MAX_RENDEDER_PORT {
-			if _, ok := busyPorts[p]; !ok {
-				// Check that port is free
-				if !isFreePort(p) {
-					continue
-				}
-				// Check that chrome ports is free
-				for _, cp := range chromePorts(p) {
-					if !isFreePort(cp) {
-						continue
-					}
-				}
-				// Check that chrome ports is free
-				busyPorts[p] = true
-				return p
-			}
-		}
-
-	}
-	log.Print("Can't allocate PORT")
-	return MIN_RENDEDER_PORT
-}
-
-// Spawn render worker at specified port
-func spawnRenderer(port int) error {
-	args := []string{"-port", fmt.Sprintf("%d", port)}
-	cmd := exec.Command("./bin/render", args...)
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-		return err
-	}
-	return nil
-}
-
-// Chrome may take 2 ports.
-// It'll be from -10000 to -9999
-func chromePorts(port int) []int {
-	return []int{
-		port - 10000,
-		port - 9999,
-	}
-}
-
-
-// Checks that port is free
-// True for free port
-func isFreePort(p int) bool {
-	conn, _ := net.Dial("tcp", net.JoinHostPort("127.0.0.1", string(p)))
-	if conn != nil {
-		conn.Close()
-		return false
-	}
-	return true
-}
-
-func sampleIcomingQueue(chJobs chan models.Job) {
+func sampleIcomingQueue(queue *JobQueue) {
 	jobs := []models.Job{
 		{
 			Url: "http://google.com",
@@ -222,7 +235,7 @@ func sampleIcomingQueue(chJobs chan models.Job) {
 	for {
 		for _, j := range jobs {
 			time.Sleep(5 * time.Second)
-			chJobs <- j
+			queue.Push(j)
 		}
 	}
 
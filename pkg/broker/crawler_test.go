@@ -0,0 +1,277 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/c12o16h1/shender/pkg/cache"
+	"github.com/c12o16h1/shender/pkg/models"
+	"github.com/c12o16h1/shender/pkg/render"
+)
+
+// In-memory cache, so tests don't touch disk
+type memCache struct {
+	mtx sync.Mutex
+	kv  map[string][]byte
+}
+
+func newMemCache() *memCache {
+	return &memCache{kv: make(map[string][]byte)}
+}
+
+func (c *memCache) Set(k []byte, v []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.kv[string(k)] = append([]byte(nil), v...)
+	return nil
+}
+
+func (c *memCache) Setex(k []byte, ttl time.Duration, v []byte) error {
+	return c.Set(k, v)
+}
+
+func (c *memCache) Get(k []byte) ([]byte, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	v, ok := c.kv[string(k)]
+	if !ok {
+		return nil, cache.ErrorNotFound
+	}
+	return v, nil
+}
+
+func (c *memCache) Spop(prefix []byte, amount uint) ([][]byte, error) {
+	return nil, nil
+}
+
+func (c *memCache) Scan(prefix []byte, amount uint) ([]cache.KV, error) {
+	return c.ScanFrom(prefix, prefix, amount)
+}
+
+func (c *memCache) ScanFrom(prefix []byte, from []byte, amount uint) ([]cache.KV, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	var keys []string
+	for k := range c.kv {
+		if strings.HasPrefix(k, string(prefix)) && k >= string(from) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var res []cache.KV
+	for _, k := range keys {
+		if uint(len(res)) == amount {
+			break
+		}
+		res = append(res, cache.KV{Key: []byte(k), Value: c.kv[k]})
+	}
+	return res, nil
+}
+
+func (c *memCache) Delete(k []byte) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.kv, string(k))
+	return nil
+}
+
+func (c *memCache) Close() {}
+
+// Crawler with fake renderer
+func newTestCrawler(t *testing.T, workers int, result func(req models.RenderRequest) (models.RenderResult, error)) (*Crawler, *cache.Queue) {
+	results, err := cache.NewQueue(newMemCache(), "results", 0)
+	if err != nil {
+		t.Fatalf("Can't open queue: %s", err)
+	}
+	c := &Crawler{
+		renderer: &render.Fake{Result: result},
+		timeout:  time.Second,
+		jobs:     NewJobQueue(100),
+		results:  results,
+		workers:  workers,
+		ready:    func() bool { return true },
+	}
+	return c, results
+}
+
+func popResult(t *testing.T, results *cache.Queue) models.JobResult {
+	_, b, err := results.Pop()
+	if err != nil {
+		t.Fatalf("Can't pop result: %s", err)
+	}
+	var res models.JobResult
+	if err := json.Unmarshal(b, &res); err != nil {
+		t.Fatalf("Invalid result: %s", err)
+	}
+	return res
+}
+
+func TestCrawler(t *testing.T) {
+	const workers, amount = 3, 20
+	var running, max int32
+	c, results := newTestCrawler(t, workers, func(req models.RenderRequest) (models.RenderResult, error) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return models.RenderResult{HTML: "<html>" + req.URL + "</html>"}, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < amount; i++ {
+		c.jobs.Push(models.Job{Url: "example.com/" + string(rune('a'+i))})
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < amount; i++ {
+		res := popResult(t, results)
+		if res.Status != models.JobOk || res.HTML != "<html>http://"+res.Url+"</html>" {
+			t.Fatalf("Unexpected result: %+v", res)
+		}
+		seen[res.Url] = true
+	}
+	if len(seen) != amount {
+		t.Fatalf("Expected %d different results, got %d", amount, len(seen))
+	}
+	if m := atomic.LoadInt32(&max); m > workers {
+		t.Fatalf("Expected at most %d jobs at once, got %d", workers, m)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Crawler didn't stop")
+	}
+}
+
+func TestCrawlerDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	c, results := newTestCrawler(t, 2, func(req models.RenderRequest) (models.RenderResult, error) {
+		close(started)
+		<-release
+		return models.RenderResult{HTML: "<html></html>"}, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	c.jobs.Push(models.Job{Url: "example.com/"})
+	<-started
+
+	// Job in progress is finished before crawler stops
+	cancel()
+	select {
+	case <-done:
+		t.Fatal("Crawler stopped before job in progress finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Crawler didn't stop")
+	}
+	if res := popResult(t, results); res.Url != "example.com/" {
+		t.Fatalf("Unexpected result: %+v", res)
+	}
+}
+
+func TestCrawlerNotReady(t *testing.T) {
+	var calls int32
+	c, _ := newTestCrawler(t, 2, func(req models.RenderRequest) (models.RenderResult, error) {
+		atomic.AddInt32(&calls, 1)
+		return models.RenderResult{HTML: "<html></html>"}, nil
+	})
+	c.ready = func() bool { return false }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Run(ctx)
+		close(done)
+	}()
+	c.jobs.Push(models.Job{Url: "example.com/"})
+
+	// Job waits for resources, and waiting doesn't hold up stop
+	time.Sleep(10 * MAIN_LOOP_TIMEOUT)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Crawler didn't stop")
+	}
+	if n := atomic.LoadInt32(&calls); n != 0 || c.jobs.Len() != 1 {
+		t.Fatalf("Expected job not to be taken, got %d renders, %d jobs", n, c.jobs.Len())
+	}
+}
+
+func TestCrawlerRetry(t *testing.T) {
+	var calls int32
+	c, results := newTestCrawler(t, 1, func(req models.RenderRequest) (models.RenderResult, error) {
+		atomic.AddInt32(&calls, 1)
+		// Empty page is failure, not result
+		return models.RenderResult{}, nil
+	})
+	c.handleJob(models.Job{Url: "example.com/"})
+	if c.jobs.Len() != 1 {
+		t.Fatalf("Expected failed job to be queued again, got %d jobs", c.jobs.Len())
+	}
+	c.handleJob(models.Job{Url: "example.com/", Attempts: JOB_MAX_ATTEMPTS - 1})
+	res := popResult(t, results)
+	if res.Status != models.JobFailed || res.Reason != models.ERR_EMPTY_RESULT.Error() {
+		t.Fatalf("Expected failure to be reported, got %+v", res)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	q := NewJobQueue(10)
+	failed := models.JobResult{Job: models.Job{Url: "example.com/"}, Status: models.JobFailed}
+	for i := 1; i < JOB_MAX_ATTEMPTS; i++ {
+		if !retry(q, failed) {
+			t.Fatalf("Expected attempt %d to be retried", i)
+		}
+		j, _, ok := q.next(time.Now().Add(JOB_RETRY_MAX))
+		if !ok || j.Attempts != i || j.NotBefore <= time.Now().Unix() {
+			t.Fatalf("Expected job to be delayed, got %v %+v", ok, j)
+		}
+		failed.Job = j
+	}
+	if retry(q, failed) {
+		t.Fatal("Expected job to be given up")
+	}
+
+	// Job which can't be retried before deadline is given up
+	failed.Job = models.Job{Url: "example.com/", Deadline: time.Now().Add(time.Second).Unix()}
+	if retry(q, failed) {
+		t.Fatal("Expected job past deadline to be given up")
+	}
+
+	if retryDelay(1) != JOB_RETRY_MIN || retryDelay(2) != 2*JOB_RETRY_MIN || retryDelay(100) != JOB_RETRY_MAX {
+		t.Fatal("Unexpected retry delays")
+	}
+}
+
+func TestDoJobTimeout(t *testing.T) {
+	res := doJob(&render.Fake{Delay: time.Second}, 10*time.Millisecond, models.Job{Url: "example.com/"})
+	if res.Status != models.JobFailed || res.Reason != models.ERR_RENDER_TIMEOUT.Error() {
+		t.Fatalf("Expected render to time out, got %+v", res)
+	}
+}
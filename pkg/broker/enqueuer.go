@@ -6,22 +6,32 @@ import (
 	"time"
 
 	"github.com/c12o16h1/shender/pkg/cache"
+	"github.com/c12o16h1/shender/pkg/config"
 	"github.com/c12o16h1/shender/pkg/models"
-	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
 const (
 	ENQUEUE_SLEEP_TIMEOUT time.Duration = 30 * time.Second
+	ENQUEUE_RETRY_TTL     time.Duration = 24 * time.Hour // URL which server didn't accept is enqueued again for this time
+	// Bot is waiting for new page, so it isn't rendered later than this,
+	// by then URL is enqueued again anyway, as it's stuck
+	ENQUEUE_NEW_DEADLINE = cache.TRACK_SENT_TIMEOUT
 )
 
 var (
 	prefixLen = len(models.PREFIX_ENQUEUE) // (len(PREFIX_ENQUEUE) - 1) + 1 (for semicolon)
+	flightLen = len(models.PREFIX_ENQUEUE_FLIGHT)
 )
 /*
 Enqueuer sends app URL to server to enqueue to be crawled
  */
-func Enqueue(cacher *cache.Cacher, conn *models.WSConn, appID string, sleeperCh <-chan time.Duration) error {
+func Enqueue(cacher *cache.Cacher, tracker *cache.Tracker, conn *models.WSConn, outbox *Outbox, app *config.AppConfig, sleeperCh <-chan time.Duration) error {
+	proto := conn.Protocol()
+	amount := uint(5)
+	if proto.Can(models.CAP_BATCH) {
+		amount = ENQUEUE_BATCH_SIZE
+	}
 	// Enqueue our URL to push into server
 	for {
 		select {
@@ -29,14 +39,35 @@ func Enqueue(cacher *cache.Cacher, conn *models.WSConn, appID string, sleeperCh
 			// Sleep
 			time.Sleep(sleepTime)
 		default:
-			urls, err := getURLs(*cacher, 5)
+			items, err := getURLs(*cacher, amount)
 			if err != nil {
 				log.Print(err)
 			}
-			for _, url := range urls {
-				// remove PREFIX_ENQUEUE
-				url = url[prefixLen:]
-				if err := enqueueUrl(url, appID, conn); err != nil {
+			var batch []models.URLRich
+			var batchKeys []string
+			for n, i := range items {
+				key := string(i.Key)
+				url, device := models.ParseCacheKey(key)
+				u, err := newURLRich(url, models.DeviceByName(device), models.ParsePriority(i.Value), app, proto)
+				if err != nil {
+					// Server can't render it, so it's dropped
+					log.Print("Enqueue: ", url, ": ", err)
+					drop(*cacher, tracker, key, err)
+					continue
+				}
+				if proto.Can(models.CAP_BATCH) {
+					batch = append(batch, u)
+					batchKeys = append(batchKeys, key)
+					continue
+				}
+				if err := send(conn, outbox, models.TypeRequestSendURL, u, *cacher, tracker, []string{key}); err != nil {
+					// Failed URL is kept by outbox, rest weren't handed to it, so they're enqueued again
+					releaseAll(*cacher, items[n+1:])
+					return err
+				}
+			}
+			if len(batch) > 0 {
+				if err := send(conn, outbox, models.TypeRequestSendURLs, batch, *cacher, tracker, batchKeys); err != nil {
 					return err
 				}
 			}
@@ -46,40 +77,138 @@ func Enqueue(cacher *cache.Cacher, conn *models.WSConn, appID string, sleeperCh
 	}
 }
 
-// Get non-cached URLS to enqueue them later
-func getURLs(cacher cache.Cacher, amount uint) ([]string, error) {
-	urls, err := cacher.Spop([]byte(models.PREFIX_ENQUEUE), amount)
+// Get non-cached URLS to enqueue them with their priorities, they are marked as in flight until server accepts them
+func getURLs(cacher cache.Cacher, amount uint) ([]cache.KV, error) {
+	items, err := cacher.Scan([]byte(models.PREFIX_ENQUEUE), amount)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "getURLs: cacher.Scan:")
 	}
-	var result []string
-	for _, url := range urls {
-		result = append(result, string(url))
+	var result []cache.KV
+	for _, i := range items {
+		// remove PREFIX_ENQUEUE
+		key := string(i.Key[prefixLen:])
+		if err := cacher.Set([]byte(models.PREFIX_ENQUEUE_FLIGHT+key), i.Value); err != nil {
+			return result, errors.Wrap(err, "getURLs: cacher.Set:")
+		}
+		if err := cacher.Delete(i.Key); err != nil {
+			return result, errors.Wrap(err, "getURLs: cacher.Delete:")
+		}
+		result = append(result, cache.KV{Key: []byte(key), Value: i.Value})
 	}
 	return result, nil
 }
 
-func enqueueUrl(url string, appID string, conn *models.WSConn) error {
-	urlRich := models.URLRich{
-		Url:   url,
-		AppID: appID,
+// Return URL which server didn't accept to enqueue, with its priority
+func release(cacher cache.Cacher, key string) error {
+	// URL without priority is enqueued as new page
+	priority, _ := cacher.Get([]byte(models.PREFIX_ENQUEUE_FLIGHT + key))
+	if err := cacher.Setex([]byte(models.PREFIX_ENQUEUE+key), ENQUEUE_RETRY_TTL, priority); err != nil {
+		return errors.Wrap(err, "release: cacher.Setex:")
 	}
-	bUrl, err := json.Marshal(urlRich)
-	if err != nil {
-		return errors.Wrap(err, "enqueueUrl: json.Marshal:")
+	if err := cacher.Delete([]byte(models.PREFIX_ENQUEUE_FLIGHT + key)); err != nil {
+		return errors.Wrap(err, "release: cacher.Delete:")
 	}
+	return nil
+}
 
-	msg := models.WSMessage{
-		Type: models.TypeRequestSendURL,
-		Data: string(bUrl),
+// Return URLs taken from queue, which weren't sent
+func releaseAll(cacher cache.Cacher, items []cache.KV) {
+	for _, i := range items {
+		if err := release(cacher, string(i.Key)); err != nil {
+			log.Print("Enqueue: ", err)
+		}
 	}
-	b, err := json.Marshal(msg)
-	if err != nil {
-		return errors.Wrap(err, "enqueueUrl: json.Marshal:")
+}
+
+// Enqueue again URLs which were in flight before restart
+func RecoverEnqueued(cacher cache.Cacher) error {
+	for {
+		items, err := cacher.Scan([]byte(models.PREFIX_ENQUEUE_FLIGHT), 100)
+		if err != nil {
+			return errors.Wrap(err, "RecoverEnqueued: cacher.Scan:")
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		for _, i := range items {
+			if err := release(cacher, string(i.Key[flightLen:])); err != nil {
+				return errors.Wrap(err, "RecoverEnqueued:")
+			}
+		}
 	}
-	err = conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+const (
+	ERR_DEVICES_UNSUPPORTED = models.Error("Server doesn't support device profiles")
+)
+
+// URL with options how owner wants it to be rendered, adapted to what server supports
+func newURLRich(url string, device models.Device, priority models.Priority, app *config.AppConfig, proto models.Protocol) (models.URLRich, error) {
+	// Server would render desktop page, which must not be cached for other device
+	if device.Name != models.DeviceDesktop.Name && !proto.Can(models.CAP_DEVICES) {
+		return models.URLRich{}, ERR_DEVICES_UNSUPPORTED
+	}
+	u := models.URLRich{
+		Url:      url,
+		AppID:    app.ID,
+		Device:   device,
+		Options:  app.Render,
+		Replicas: app.Replicas,
+		Priority: priority,
+	}
+	if priority == models.PriorityNew {
+		u.Deadline = time.Now().Add(ENQUEUE_NEW_DEADLINE).Unix()
+	}
+	if !proto.Can(models.CAP_SCREENSHOT) {
+		u.Options.Screenshot = ""
+	}
+	if !proto.Can(models.CAP_PDF) {
+		u.Options.PDF = false
+	}
+	return u, nil
+}
+
+// Send URL or batch of URLs, they are in flight until server accepts them, otherwise they are enqueued again
+func send(conn *models.WSConn, outbox *Outbox, t models.WSType, data interface{}, cacher cache.Cacher, tracker *cache.Tracker, keys []string) error {
+	b, err := json.Marshal(data)
 	if err != nil {
-		return errors.Wrap(err, "enqueueUrl: write:")
+		return errors.Wrap(err, "send: json.Marshal:")
+	}
+	msg := models.WSMessage{
+		Type: t,
+		Data: string(b),
+	}
+	done := func(err error) {
+		finish(cacher, tracker, keys, err)
+	}
+	if err := outbox.Send(conn, msg, done); err != nil {
+		return errors.Wrap(err, "send: outbox.Send:")
 	}
 	return nil
 }
+
+// Mark URLs accepted by server as sent, or enqueue them again
+func finish(cacher cache.Cacher, tracker *cache.Tracker, keys []string, err error) {
+	for _, key := range keys {
+		var ferr error
+		if err != nil {
+			ferr = release(cacher, key)
+		} else if ferr = cacher.Delete([]byte(models.PREFIX_ENQUEUE_FLIGHT + key)); ferr == nil {
+			ferr = tracker.Mark(key, models.URLSent, "")
+		}
+		if ferr != nil {
+			log.Print("Enqueue: ", ferr)
+		}
+	}
+}
+
+// Forget URL which can't be rendered
+func drop(cacher cache.Cacher, tracker *cache.Tracker, key string, reason error) {
+	err := cacher.Delete([]byte(models.PREFIX_ENQUEUE_FLIGHT + key))
+	if err == nil {
+		err = tracker.Mark(key, models.URLFailed, reason.Error())
+	}
+	if err != nil {
+		log.Print("Enqueue: ", err)
+	}
+}
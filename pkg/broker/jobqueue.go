@@ -0,0 +1,197 @@
+package broker
+
+import (
+	"container/heap"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	JOB_QUEUE_IDLE_TIMEOUT = 1 * time.Minute // Max wait for job when there are no delayed ones, pushes wake up earlier
+
+	ERR_JOB_EXPIRED = models.Error("Deadline of job passed before it was started")
+)
+
+/*
+JobQueue is a bounded queue of jobs to crawl, ordered by priority,
+then by deadline, then by arrival.
+Jobs wait until their not-before time, jobs past deadline are dropped
+and handed to OnExpired callback, so server is told about them.
+*/
+type JobQueue struct {
+	slots chan struct{} // Taken by every job in queue, so Push blocks when queue is full
+
+	mtx     sync.Mutex
+	seq     int64
+	ready   jobHeap // Jobs which may be started, by priority
+	delayed jobHeap // Jobs waiting for not-before time, by it
+	expired []models.Job
+	notify  chan struct{}
+
+	onExpired func(models.Job)
+}
+
+func NewJobQueue(limit uint) *JobQueue {
+	return &JobQueue{
+		slots:   make(chan struct{}, limit),
+		ready:   jobHeap{less: byPriority},
+		delayed: jobHeap{less: byNotBefore},
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Set callback for jobs dropped as expired, it's called without lock
+func (q *JobQueue) OnExpired(f func(models.Job)) {
+	q.mtx.Lock()
+	q.onExpired = f
+	q.mtx.Unlock()
+}
+
+// Add job, blocks while queue is full
+func (q *JobQueue) Push(j models.Job) {
+	q.slots <- struct{}{}
+	q.add(j)
+}
+
+// Add job if queue isn't full
+func (q *JobQueue) TryPush(j models.Job) bool {
+	select {
+	case q.slots <- struct{}{}:
+		q.add(j)
+		return true
+	default:
+		return false
+	}
+}
+
+// Caller took slot
+func (q *JobQueue) add(j models.Job) {
+	q.mtx.Lock()
+	q.seq++
+	item := queuedJob{Job: j, seq: q.seq}
+	if j.NotBefore > time.Now().Unix() {
+		heap.Push(&q.delayed, item)
+	} else {
+		heap.Push(&q.ready, item)
+	}
+	q.mtx.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Take most urgent job, blocks until there is one which may be started or context is done
+func (q *JobQueue) Pop(ctx context.Context) (models.Job, error) {
+	for {
+		j, wait, ok := q.next(time.Now())
+		q.dropExpired()
+		if ok {
+			return j, nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-q.notify:
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return models.Job{}, ctx.Err()
+		}
+		t.Stop()
+	}
+}
+
+// Amount of jobs in queue
+func (q *JobQueue) Len() int {
+	return len(q.slots)
+}
+
+// Max amount of jobs in queue
+func (q *JobQueue) Cap() int {
+	return cap(q.slots)
+}
+
+// Hand expired jobs to callback
+func (q *JobQueue) dropExpired() {
+	q.mtx.Lock()
+	expired, f := q.expired, q.onExpired
+	q.expired = nil
+	q.mtx.Unlock()
+	if f == nil {
+		return
+	}
+	for _, j := range expired {
+		f(j)
+	}
+}
+
+// Most urgent job, or time to wait for delayed one
+func (q *JobQueue) next(now time.Time) (models.Job, time.Duration, bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for q.delayed.Len() > 0 && q.delayed.items[0].NotBefore <= now.Unix() {
+		heap.Push(&q.ready, heap.Pop(&q.delayed))
+	}
+	for q.ready.Len() > 0 {
+		j := heap.Pop(&q.ready).(queuedJob).Job
+		<-q.slots
+		if j.Expired(now) {
+			log.Print("JobQueue: deadline passed: ", j.Url)
+			metricJobsExpired.Add(1)
+			q.expired = append(q.expired, j)
+			continue
+		}
+		return j, 0, true
+	}
+	wait := JOB_QUEUE_IDLE_TIMEOUT
+	if q.delayed.Len() > 0 {
+		wait = time.Unix(q.delayed.items[0].NotBefore, 0).Sub(now)
+	}
+	return models.Job{}, wait, false
+}
+
+type queuedJob struct {
+	models.Job
+	seq int64 // Order of arrival
+}
+
+func byPriority(a, b queuedJob) bool {
+	if a.Priority != b.Priority {
+		return a.Priority < b.Priority
+	}
+	// Jobs without deadline wait for ones with it
+	if a.Deadline != b.Deadline {
+		if a.Deadline == 0 || b.Deadline == 0 {
+			return b.Deadline == 0
+		}
+		return a.Deadline < b.Deadline
+	}
+	return a.seq < b.seq
+}
+
+func byNotBefore(a, b queuedJob) bool {
+	if a.NotBefore != b.NotBefore {
+		return a.NotBefore < b.NotBefore
+	}
+	return a.seq < b.seq
+}
+
+// Implements heap.Interface
+type jobHeap struct {
+	items []queuedJob
+	less  func(a, b queuedJob) bool
+}
+
+func (h jobHeap) Len() int            { return len(h.items) }
+func (h jobHeap) Less(i, j int) bool  { return h.less(h.items[i], h.items[j]) }
+func (h jobHeap) Swap(i, j int)       { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *jobHeap) Push(x interface{}) { h.items = append(h.items, x.(queuedJob)) }
+func (h *jobHeap) Pop() interface{} {
+	j := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return j
+}
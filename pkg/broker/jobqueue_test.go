@@ -0,0 +1,48 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+func TestJobQueue(t *testing.T) {
+	now := time.Now()
+	q := NewJobQueue(10)
+	var expired []string
+	q.OnExpired(func(j models.Job) {
+		expired = append(expired, j.Url)
+	})
+	q.Push(models.Job{Url: "warm", Priority: models.PriorityWarm})
+	q.Push(models.Job{Url: "refresh", Priority: models.PriorityRefresh})
+	q.Push(models.Job{Url: "new"})
+	q.Push(models.Job{Url: "new-deadline", Deadline: now.Add(time.Hour).Unix()})
+	q.Push(models.Job{Url: "expired", Deadline: now.Add(-time.Hour).Unix()})
+	q.Push(models.Job{Url: "delayed", NotBefore: now.Add(time.Hour).Unix()})
+	if q.Len() != 6 {
+		t.Fatalf("Expected 6 jobs, got %d", q.Len())
+	}
+
+	for _, url := range []string{"new-deadline", "new", "refresh", "warm"} {
+		j, err := q.Pop(context.Background())
+		if err != nil || j.Url != url {
+			t.Fatalf("Expected %s, got %s", url, j.Url)
+		}
+	}
+	// Expired job is dropped and reported, delayed one waits
+	if len(expired) != 1 || expired[0] != "expired" {
+		t.Fatalf("Expected expired job to be reported, got %v", expired)
+	}
+	if _, wait, ok := q.next(now); ok || wait <= 0 {
+		t.Fatalf("Expected to wait for delayed job, got %v %v", ok, wait)
+	}
+	j, _, ok := q.next(now.Add(2 * time.Hour))
+	if !ok || j.Url != "delayed" {
+		t.Fatalf("Expected delayed job, got %v %s", ok, j.Url)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("Expected empty queue, got %d", q.Len())
+	}
+}
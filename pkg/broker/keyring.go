@@ -0,0 +1,238 @@
+package broker
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/cache"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	PEER_KEY_TIMEOUT    = 10 * time.Second   // Max time to wait for key of peer from server
+	SIGNATURE_MAX_AGE   = 7 * 24 * time.Hour // Older signatures are rejected, so old pages can't be replayed
+	SIGNATURE_MAX_SKEW  = 5 * time.Minute    // Allowed clock difference with peers
+	KEYRING_QUEUE_LIMIT = 100                // Max amount of pending messages to server
+
+	ERR_UNSIGNED          = models.Error("Page isn't signed")
+	ERR_INVALID_SIGNATURE = models.Error("Invalid signature")
+	ERR_EXPIRED_SIGNATURE = models.Error("Signature is expired")
+	ERR_BANNED_PEER       = models.Error("Peer is banned")
+	ERR_UNKNOWN_PEER      = models.Error("Key of peer is unknown")
+	ERR_INVALID_KEY       = models.Error("Invalid key")
+)
+
+/*
+Keyring keeps public keys of peers registered on server
+and checks provenance of pages rendered by them.
+Peer named by page is only a claim until signature is verified,
+so forged pages are rejected, but peer they name is never banned for them.
+Peer which signed page pretending to be other site is banned and reported to server.
+*/
+type Keyring struct {
+	cacher cache.Cacher
+
+	mtx     sync.Mutex
+	keys    map[string]ed25519.PublicKey // Keys by AppID of peer
+	waiting map[string][]chan struct{}   // Waiting for key of peer from server
+	banned  map[string]bool
+
+	outgoing chan models.WSMessage // Messages to server: key requests and reports
+}
+
+// Create keyring, bans are stored in cache and survive restarts
+func NewKeyring(cacher cache.Cacher, banned []string) *Keyring {
+	k := Keyring{
+		cacher:   cacher,
+		keys:     make(map[string]ed25519.PublicKey),
+		waiting:  make(map[string][]chan struct{}),
+		banned:   make(map[string]bool),
+		outgoing: make(chan models.WSMessage, KEYRING_QUEUE_LIMIT),
+	}
+	for _, p := range banned {
+		k.banned[p] = true
+	}
+	return &k
+}
+
+// Add key of peer received from server
+func (k *Keyring) Add(peer string, key ed25519.PublicKey) {
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	k.keys[peer] = key
+	for _, ch := range k.waiting[peer] {
+		close(ch)
+	}
+	delete(k.waiting, peer)
+}
+
+// Get key of peer, asking server for it if it's unknown
+func (k *Keyring) Get(peer string) (ed25519.PublicKey, error) {
+	k.mtx.Lock()
+	if key, ok := k.keys[peer]; ok {
+		k.mtx.Unlock()
+		return key, nil
+	}
+	ch := make(chan struct{})
+	first := len(k.waiting[peer]) == 0
+	k.waiting[peer] = append(k.waiting[peer], ch)
+	k.mtx.Unlock()
+
+	if first {
+		k.send(models.WSMessage{
+			Type:    models.TypeRequestPeerKey,
+			Message: peer,
+		})
+	}
+	select {
+	case <-ch:
+	case <-time.After(PEER_KEY_TIMEOUT):
+	}
+
+	k.mtx.Lock()
+	defer k.mtx.Unlock()
+	key, ok := k.keys[peer]
+	if !ok {
+		// Server didn't answer, next call asks again
+		delete(k.waiting, peer)
+		return nil, ERR_UNKNOWN_PEER
+	}
+	return key, nil
+}
+
+// Check that page is signed by peer which rendered it
+func (k *Keyring) Check(p models.DataResponseCachedPage) error {
+	if p.Peer == "" || len(p.Signature) == 0 {
+		return ERR_UNSIGNED
+	}
+	if k.Banned(p.Peer) {
+		return ERR_BANNED_PEER
+	}
+	signed := time.Unix(p.Timestamp, 0)
+	if time.Since(signed) > SIGNATURE_MAX_AGE || time.Until(signed) > SIGNATURE_MAX_SKEW {
+		return ERR_EXPIRED_SIGNATURE
+	}
+	key, err := k.Get(p.Peer)
+	if err != nil {
+		return err
+	}
+	// Anyone may name honest peer in forged page, so it's rejected, not reported
+	if p.Hash != models.HTMLHash(p.HTML) || !ed25519.Verify(key, models.SignaturePayload(p), p.Signature) {
+		return ERR_INVALID_SIGNATURE
+	}
+	return nil
+}
+
+// Ban peer and report them to server
+func (k *Keyring) Ban(peer string, reason string) {
+	k.mtx.Lock()
+	k.banned[peer] = true
+	k.mtx.Unlock()
+
+	log.Printf("Keyring: peer %s is banned: %s", peer, reason)
+	if err := k.cacher.Set([]byte(models.PREFIX_BANNED+peer), []byte(reason)); err != nil {
+		log.Print("Keyring: ", err)
+	}
+	k.send(models.WSMessage{
+		Type:    models.TypeReportPeer,
+		AppID:   peer,
+		Message: reason,
+	})
+}
+
+// Check whether peer is banned
+func (k *Keyring) Banned(peer string) bool {
+	k.mtx.Lock()
+	banned := k.banned[peer]
+	k.mtx.Unlock()
+	if banned {
+		return true
+	}
+	if v, err := k.cacher.Get([]byte(models.PREFIX_BANNED + peer)); err == nil && v != nil {
+		k.mtx.Lock()
+		k.banned[peer] = true
+		k.mtx.Unlock()
+		return true
+	}
+	return false
+}
+
+// Queue message to server, it's dropped if server is unreachable for too long
+func (k *Keyring) send(m models.WSMessage) {
+	select {
+	case k.outgoing <- m:
+	default:
+		log.Print("Keyring: outgoing queue is full")
+	}
+}
+
+/*
+SyncKeys registers public key of this broker on server,
+and sends key requests and reports of keyring
+*/
+func SyncKeys(conn *models.WSConn, appID string, key ed25519.PrivateKey, k *Keyring) error {
+	// Server doesn't exchange keys, so pages of peers can't be checked and are dropped
+	if !conn.Protocol().Can(models.CAP_SIGNATURES) {
+		log.Print("SyncKeys: server doesn't support signatures")
+		<-conn.Done()
+		return nil
+	}
+	msg := models.WSMessage{
+		Type:  models.TypeRegisterKey,
+		AppID: appID,
+		Data:  base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}
+	for {
+		if err := conn.Send(msg); err != nil {
+			// Message is lost together with connection, but it'll be asked again
+			return errors.Wrap(err, "SyncKeys: send:")
+		}
+		msg = <-k.outgoing
+	}
+}
+
+// Sign page rendered by this broker
+func Sign(p *models.DataResponseCachedPage, key ed25519.PrivateKey) {
+	p.Hash = models.HTMLHash(p.HTML)
+	p.Timestamp = time.Now().Unix()
+	p.Signature = ed25519.Sign(key, models.SignaturePayload(*p))
+}
+
+// Parse base64 public key received from server
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, ERR_INVALID_KEY
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// Load private key of this broker, or create new one if there is no key yet
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(b) != ed25519.PrivateKeySize {
+			return nil, ERR_INVALID_KEY
+		}
+		return ed25519.PrivateKey(b), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "LoadKey: ioutil.ReadFile:")
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "LoadKey: ed25519.GenerateKey:")
+	}
+	if err := ioutil.WriteFile(path, key, 0600); err != nil {
+		return nil, errors.Wrap(err, "LoadKey: ioutil.WriteFile:")
+	}
+	return key, nil
+}
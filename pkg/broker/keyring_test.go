@@ -0,0 +1,44 @@
+package broker
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+func TestKeyringCheck(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := NewKeyring(newMemCache(), nil)
+	k.Add("peer", pub)
+
+	p := models.DataResponseCachedPage{
+		URL:        "example.com/",
+		HTML:       "<html></html>",
+		Device:     models.DEVICE_DESKTOP,
+		Peer:       "peer",
+		Screenshot: []byte("png"),
+	}
+	Sign(&p, key)
+	if err := k.Check(p); err != nil {
+		t.Fatalf("Expected valid signature, got %s", err)
+	}
+
+	// Side outputs are signed too
+	forged := p
+	forged.Screenshot = []byte("other png")
+	if err := k.Check(forged); err != ERR_INVALID_SIGNATURE {
+		t.Fatalf("Expected invalid signature, got %v", err)
+	}
+	// Peer named by forged page isn't banned
+	if k.Banned("peer") {
+		t.Fatal("Expected peer not to be banned")
+	}
+	if err := k.Check(p); err != nil {
+		t.Fatalf("Expected valid signature after forged page, got %s", err)
+	}
+}
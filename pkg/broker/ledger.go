@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/cache"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	BALANCE_SYNC_PERIOD = 5 * time.Minute   // How often balance is asked from server, it's pushed on change too
+	SPENT_TTL           = SIGNATURE_MAX_AGE // Page can't be received again after its signature expired
+)
+
+/*
+Ledger counts render credits of this app.
+Server is authoritative, local counters only show what broker itself saw:
+credits are earned once server accepted page rendered by us,
+and spent for every valid page rendered for us by peer.
+Both balances are stored in cache and survive restarts.
+*/
+type Ledger struct {
+	cacher cache.Cacher
+
+	mtx   sync.Mutex
+	local models.Balance
+}
+
+func NewLedger(cacher cache.Cacher, appID string) (*Ledger, error) {
+	l := Ledger{cacher: cacher}
+	b, err := cacher.Get([]byte(models.CREDITS_LOCAL))
+	if err == nil && len(b) > 0 {
+		if err := json.Unmarshal(b, &l.local); err != nil {
+			return nil, errors.Wrap(err, "NewLedger: json.Unmarshal:")
+		}
+	}
+	l.local.AppID = appID
+	return &l, nil
+}
+
+// Page rendered by us is accepted by server
+func (l *Ledger) Earn(n int64) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.local.Earned += n
+	metricCreditsEarned.Add(n)
+	return l.save()
+}
+
+// Page rendered by peer is stored, credit is spent once per page, even if it's stored again
+func (l *Ledger) Spend(page string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	key := []byte(models.CREDITS_SPENT + page)
+	if _, err := l.cacher.Get(key); err == nil {
+		return nil
+	} else if err != cache.ErrorNotFound {
+		return errors.Wrap(err, "Ledger.Spend: cacher.Get:")
+	}
+	l.local.Spent++
+	metricCreditsSpent.Add(1)
+	if err := l.save(); err != nil {
+		return err
+	}
+	if err := l.cacher.Setex(key, SPENT_TTL, []byte{1}); err != nil {
+		return errors.Wrap(err, "Ledger.Spend: cacher.Setex:")
+	}
+	return nil
+}
+
+// Local balance, as counted by broker
+func (l *Ledger) Local() models.Balance {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.local
+}
+
+// Store balance reported by server
+func (l *Ledger) Update(b models.Balance) error {
+	if b.Updated == 0 {
+		b.Updated = time.Now().Unix()
+	}
+	v, err := json.Marshal(b)
+	if err != nil {
+		return errors.Wrap(err, "Ledger.Update: json.Marshal:")
+	}
+	if err := l.cacher.Set([]byte(models.CREDITS_SERVER), v); err != nil {
+		return errors.Wrap(err, "Ledger.Update: cacher.Set:")
+	}
+	return nil
+}
+
+/*
+Sync asks server for balance of this app after connect and then periodically,
+until connection is closed. Servers without credits are never asked.
+*/
+func (l *Ledger) Sync(conn *models.WSConn, appID string) error {
+	if !conn.Protocol().Can(models.CAP_CREDITS) {
+		<-conn.Done()
+		return nil
+	}
+	for {
+		msg := models.WSMessage{
+			Type:  models.TypeRequestBalance,
+			AppID: appID,
+		}
+		if err := conn.Send(msg); err != nil {
+			return errors.Wrap(err, "Ledger.Sync: send:")
+		}
+		select {
+		case <-time.After(BALANCE_SYNC_PERIOD):
+		case <-conn.Done():
+			return nil
+		}
+	}
+}
+
+// Caller holds lock
+func (l *Ledger) save() error {
+	l.local.Balance = l.local.Earned - l.local.Spent
+	l.local.Updated = time.Now().Unix()
+	b, err := json.Marshal(l.local)
+	if err != nil {
+		return errors.Wrap(err, "Ledger.save: json.Marshal:")
+	}
+	if err := l.cacher.Set([]byte(models.CREDITS_LOCAL), b); err != nil {
+		return errors.Wrap(err, "Ledger.save: cacher.Set:")
+	}
+	return nil
+}
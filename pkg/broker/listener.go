@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/c12o16h1/shender/pkg/cache"
 	"github.com/c12o16h1/shender/pkg/models"
 )
 
@@ -19,26 +20,37 @@ Listener listen all messages from server
  */
 func Listen(
 	conn *models.WSConn,
-	jobsCh chan<- models.Job,
-	storagerCh chan<- models.DataResponseCachedPage,
+	jobs *JobQueue,
+	storager *cache.Queue,
+	keyring *Keyring,
+	outbox *Outbox,
+	notifier *Notifier,
+	ledger *Ledger,
+	tracker *cache.Tracker,
 	sleeperRequestGetUrls chan<- time.Duration,
 	sleeperResponseCachedPage chan<- time.Duration,
 	sleeperTypeRequestSendURL chan<- time.Duration,
 	sleeperRequestCachedPage chan<- time.Duration,
 ) error {
-	for {
-		// Listen and read
-		_, message, err := conn.ReadMessage()
+	// Pages are stored on disk until processed
+	store := func(c models.DataResponseCachedPage) error {
+		b, err := json.Marshal(c)
 		if err != nil {
-			log.Println("read:", err)
 			return err
 		}
-		// Unmarshal
-		var m models.WSMessage
-		if err := json.Unmarshal(message, &m); err != nil {
+		return storager.Push(b)
+	}
+	for {
+		// Listen, read and decode
+		m, err := conn.Receive()
+		if err != nil {
+			log.Println("read:", err)
 			return err
 		}
 
+		// Answer to our message, errors are still handled below
+		outbox.Ack(m)
+
 		switch m.Type {
 		case models.TypeResponseGetUrls:
 			// Got URL to crawl
@@ -48,29 +60,95 @@ func Listen(
 					log.Print(ERR_INVALID_URL_MESSAGE)
 					continue
 				}
-				j := models.Job{
-					Token: m.Token,
-					AppID: urlRich.AppID,
-					Url:   urlRich.Url,
-				}
-				// Add to channel
-				jobsCh <- j
+				// Add to queue
+				jobs.Push(newJob(m.Token, urlRich))
 			} else {
 				log.Print(ERR_INVALID_URL_MESSAGE)
 			}
 
+		case models.TypeResponseGetUrlsN:
+			// Got batch of URLs to crawl, it's not larger than free space in queue
+			var urls []models.JobURL
+			if err := json.Unmarshal([]byte(m.Data), &urls); err != nil {
+				log.Print(ERR_INVALID_URL_MESSAGE)
+				continue
+			}
+			for _, u := range urls {
+				jobs.Push(newJob(u.Token, u.URLRich))
+			}
+
 		case models.TypeResponseCachedPage:
-			// Got cache to store
+			// Got cache to store, requested or pushed by server as soon as it's rendered.
+			// It's stored on disk until processed.
 			var c models.DataResponseCachedPage
-			if err := json.Unmarshal([]byte(m.Data), &c); err != nil {
+			if err := conn.Codec().UnmarshalPage([]byte(m.Data), &c); err != nil {
 				log.Print(ERR_INVALID_CACHE)
+			} else if err := store(c); err != nil {
+				return err
+			}
+			if err := ack(conn, m); err != nil {
+				return err
+			}
+			// Server may have more pages
+			notifier.Notify(models.NotifyCache)
+
+		case models.TypeResponseCachedN:
+			// Got batch of cache to store
+			pages, err := conn.Codec().UnmarshalPages([]byte(m.Data))
+			if err != nil {
+				log.Print(ERR_INVALID_CACHE)
+			}
+			for _, c := range pages {
+				if err := store(c); err != nil {
+					return err
+				}
+			}
+			if err := ack(conn, m); err != nil {
+				return err
+			}
+			notifier.Notify(models.NotifyCache)
+
+		case models.TypeNotify:
+			// Server has something for us
+			notifier.Notify(m.Message)
+
+		case models.TypeResponseBalance:
+			// Server counted credits of this app
+			var b models.Balance
+			if err := json.Unmarshal([]byte(m.Data), &b); err != nil {
+				log.Print("Invalid balance: ", err)
+				continue
+			}
+			if err := ledger.Update(b); err != nil {
+				log.Print(err)
+			}
+
+		case models.TypeURLState:
+			// Enqueued URL of this app is taken by peer or failed
+			var s models.URLStatus
+			if err := json.Unmarshal([]byte(m.Data), &s); err != nil {
+				log.Print("Invalid URL state: ", err)
 				continue
 			}
-			storagerCh <- c
+			if err := tracker.Mark(models.CacheKey(s.URL, s.Device), s.State, s.Reason); err != nil {
+				log.Print(err)
+			}
+
+		case models.TypeResponsePeerKey:
+			// Got key of peer to check their pages
+			key, err := ParsePublicKey(m.Data)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			keyring.Add(m.AppID, key)
 
 		case models.TypeError:
 			// Handle errors
 			switch m.Code {
+			case models.CodeAuthFailed:
+				// Session is revoked, connection has to be renewed
+				return ERR_AUTH_REJECTED
 			case models.CodeRequestGetUrls:
 				if len(sleeperRequestGetUrls) < cap(sleeperRequestGetUrls) {
 					// Listen server for reconnect timeout
@@ -90,7 +168,8 @@ func Listen(
 					}
 					sleeperResponseCachedPage <- time.Duration(t) * time.Second
 				}
-			case models.CodeRequestSendURL:
+			case models.CodeRequestSendURL, models.CodeLowBalance:
+				// Server throttles apps which don't render for others
 				if len(sleeperTypeRequestSendURL) < cap(sleeperTypeRequestSendURL) {
 					t, err := strconv.Atoi(m.Message)
 					if err != nil || t == 0 {
@@ -111,6 +190,36 @@ func Listen(
 			}
 
 		}
-		log.Printf("recv: %s", message)
+		log.Printf("recv: type %d, code %d, %d bytes", m.Type, m.Code, len(m.Data))
+	}
+}
+
+// Job from URL received from server
+func newJob(token string, u models.URLRich) models.Job {
+	// Owners without device profiles want desktop pages
+	if u.Device.Name == "" {
+		u.Device = models.DeviceDesktop
+	}
+	return models.Job{
+		Token:     token,
+		AppID:     u.AppID,
+		Url:       u.Url,
+		Device:    u.Device,
+		Options:   u.Options,
+		Priority:  u.Priority,
+		NotBefore: u.NotBefore,
+		Deadline:  u.Deadline,
+	}
+}
+
+// Acknowledge message of server, so it isn't delivered again.
+// Broken messages are acknowledged too, as they'd be broken again.
+func ack(conn *models.WSConn, m models.WSMessage) error {
+	if m.ID == "" || !conn.Protocol().Can(models.CAP_ACKS) {
+		return nil
 	}
+	return conn.Send(models.WSMessage{
+		Type:    models.TypeOk,
+		ReplyTo: m.ID,
+	})
 }
@@ -0,0 +1,21 @@
+package broker
+
+import "expvar"
+
+// Counters exposed at /debug/vars
+var (
+	metricVerifyAgreed    = expvar.NewInt("verify_agreed")    // Pages stored after quorum of peers agreed
+	metricVerifyDisagreed = expvar.NewInt("verify_disagreed") // Pages dropped, as peers rendered different content
+	metricVerifyExpired   = expvar.NewInt("verify_expired")   // Pages dropped, as not enough peers reported in time
+
+	metricOutboxAcked   = expvar.NewInt("outbox_acked")   // Messages acknowledged by server
+	metricOutboxRetried = expvar.NewInt("outbox_retried") // Messages resent, as they weren't acknowledged in time
+	metricOutboxFailed  = expvar.NewInt("outbox_failed")  // Messages given up after all attempts
+
+	metricCreditsEarned = expvar.NewInt("credits_earned") // Pages rendered by us and accepted by server
+	metricCreditsSpent  = expvar.NewInt("credits_spent")  // Pages rendered for us by peers
+
+	metricJobsExpired = expvar.NewInt("jobs_expired") // Jobs dropped from queue, as their deadline passed
+	metricJobsRetried = expvar.NewInt("jobs_retried") // Failed jobs scheduled to be rendered again
+	metricJobsFailed  = expvar.NewInt("jobs_failed")  // Jobs given up after all attempts
+)
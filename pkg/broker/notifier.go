@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+// Notifier passes notifications of server from listener to requesting routines
+type Notifier struct {
+	urls  chan struct{}
+	cache chan struct{}
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{
+		urls:  make(chan struct{}, 1),
+		cache: make(chan struct{}, 1),
+	}
+}
+
+// Notify routines waiting for kind of data, notifications aren't queued
+func (n *Notifier) Notify(kind string) {
+	var ch chan struct{}
+	switch kind {
+	case models.NotifyURLs:
+		ch = n.urls
+	case models.NotifyCache:
+		ch = n.cache
+	default:
+		return
+	}
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Server has URLs to crawl
+func (n *Notifier) URLs() <-chan struct{} {
+	return n.urls
+}
+
+// Server has cached pages
+func (n *Notifier) Cache() <-chan struct{} {
+	return n.cache
+}
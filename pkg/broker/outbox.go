@@ -0,0 +1,194 @@
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	ACK_TIMEOUT      = 30 * time.Second // Message is resent if server didn't acknowledge it in this time
+	ACK_CHECK_PERIOD = 5 * time.Second  // How often unacknowledged messages are checked
+	ACK_MAX_ATTEMPTS = 5                // Message is failed after this amount of attempts
+	OUTBOX_LIMIT     = 1000             // Max amount of unacknowledged messages, senders wait when it's reached
+
+	ERR_NOT_ACKED = models.Error("Message isn't acknowledged by server")
+)
+
+/*
+Outbox tracks messages which have to be acknowledged by server.
+Every message gets unique ID, server answers with TypeOk or TypeError
+which ReplyTo is that ID.
+Unacknowledged messages are resent, also after reconnect, so results aren't lost.
+Server must be idempotent by message ID, as message may be delivered twice.
+*/
+type Outbox struct {
+	prefix string // Unique per process, so IDs don't repeat after restart
+
+	mtx     sync.Mutex
+	seq     uint64
+	pending map[string]*pendingMessage
+	slots   chan struct{} // Limits amount of pending messages
+}
+
+type pendingMessage struct {
+	msg      models.WSMessage
+	conn     *models.WSConn // Connection message was sent to last time
+	sent     time.Time
+	attempts int
+	onDone   func(error) // Called with nil once message is acknowledged, or with error once it's failed, may be nil
+}
+
+func NewOutbox() *Outbox {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &Outbox{
+		prefix:  hex.EncodeToString(b),
+		pending: make(map[string]*pendingMessage),
+		slots:   make(chan struct{}, OUTBOX_LIMIT),
+	}
+}
+
+/*
+Send assigns ID to message and sends it.
+Message is kept until it's acknowledged, even if write failed,
+onDone is called once it's acknowledged or failed after all attempts.
+*/
+func (o *Outbox) Send(conn *models.WSConn, m models.WSMessage, onDone func(error)) error {
+	o.slots <- struct{}{}
+
+	o.mtx.Lock()
+	o.seq++
+	m.ID = o.prefix + "-" + strconv.FormatUint(o.seq, 10)
+	p := &pendingMessage{msg: m, onDone: onDone}
+	o.pending[m.ID] = p
+	o.claim(conn, p)
+	o.mtx.Unlock()
+	// Write may block until timeout, so acks aren't held up by it
+	return o.write(conn, p)
+}
+
+// Ack handles answer of server, returns false if it isn't answer to pending message
+func (o *Outbox) Ack(m models.WSMessage) bool {
+	if m.ReplyTo == "" {
+		return false
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	p, ok := o.pending[m.ReplyTo]
+	if !ok {
+		return false
+	}
+	// Errors are mostly "busy" answers, so message is retried later
+	if m.Type == models.TypeError {
+		return true
+	}
+	o.remove(m.ReplyTo)
+	metricOutboxAcked.Add(1)
+	if p.onDone != nil {
+		go p.onDone(nil)
+	}
+	return true
+}
+
+/*
+Redeliver resends messages which weren't acknowledged.
+Messages sent to previous connections are resent immediately,
+others after ACK_TIMEOUT.
+*/
+func (o *Outbox) Redeliver(conn *models.WSConn) error {
+	t := time.NewTicker(ACK_CHECK_PERIOD)
+	defer t.Stop()
+	for {
+		if err := o.redeliver(conn); err != nil {
+			return errors.Wrap(err, "Redeliver:")
+		}
+		select {
+		case <-t.C:
+		case <-conn.Done():
+			return nil
+		}
+	}
+}
+
+// Amount of unacknowledged messages
+func (o *Outbox) Len() int {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	return len(o.pending)
+}
+
+func (o *Outbox) redeliver(conn *models.WSConn) error {
+	o.mtx.Lock()
+	var due []*pendingMessage
+	for id, p := range o.pending {
+		if p.conn == conn && time.Since(p.sent) < ACK_TIMEOUT {
+			continue
+		}
+		if p.attempts >= ACK_MAX_ATTEMPTS {
+			log.Printf("Outbox: message %s of type %d is failed after %d attempts", id, p.msg.Type, p.attempts)
+			o.remove(id)
+			metricOutboxFailed.Add(1)
+			if p.onDone != nil {
+				go p.onDone(ERR_NOT_ACKED)
+			}
+			continue
+		}
+		o.claim(conn, p)
+		due = append(due, p)
+	}
+	o.mtx.Unlock()
+
+	// Messages are written without lock, so slow socket doesn't stall acks
+	for _, p := range due {
+		metricOutboxRetried.Add(1)
+		if err := o.write(conn, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count attempt of message to connection, so it isn't resent until ACK_TIMEOUT, must be called under lock
+func (o *Outbox) claim(conn *models.WSConn, p *pendingMessage) {
+	p.conn = conn
+	p.sent = time.Now()
+	p.attempts++
+}
+
+// Write claimed message, must be called without lock
+func (o *Outbox) write(conn *models.WSConn, p *pendingMessage) error {
+	// Message is encoded on every attempt, as codec may differ after reconnect
+	if err := conn.Send(p.msg); err != nil {
+		return err
+	}
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+	// Acknowledged while it was written
+	if o.pending[p.msg.ID] != p {
+		return nil
+	}
+	// Ack is awaited from the moment message is written
+	p.sent = time.Now()
+	// Servers without acks never answer, so written message is done
+	if !conn.Protocol().Can(models.CAP_ACKS) {
+		o.remove(p.msg.ID)
+		if p.onDone != nil {
+			go p.onDone(nil)
+		}
+	}
+	return nil
+}
+
+// Remove message and free its slot, must be called under lock
+func (o *Outbox) remove(id string) {
+	delete(o.pending, id)
+	<-o.slots
+}
@@ -1,48 +1,107 @@
 package broker
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"log"
 	"time"
 
+	"github.com/c12o16h1/shender/pkg/cache"
 	"github.com/c12o16h1/shender/pkg/models"
-	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
 /*
-Pushes crawled page cache to server
+Pushes crawled page cache to server.
+Result is removed from queue once server acknowledges it,
+and credit is earned for it.
+Failed jobs are reported with own message, empty page is never pushed as cache.
  */
-func Push(conn *models.WSConn, chRes <-chan models.JobResult, sleeperCh <-chan time.Duration) error {
+func Push(conn *models.WSConn, outbox *Outbox, ledger *Ledger, appID string, key ed25519.PrivateKey, results *cache.Queue, sleeperCh <-chan time.Duration) error {
 	for {
 		select {
 		case sleepTime := <-sleeperCh:
 			// Sleep
 			time.Sleep(sleepTime)
 		default:
-			res := <-chRes
-
+			id, b, err := results.Pop()
+			if err != nil {
+				return errors.Wrap(err, "Push: results.Pop:")
+			}
+			var res models.JobResult
+			if err := json.Unmarshal(b, &res); err != nil {
+				// Broken result will never be sent
+				log.Print("Push: json.Unmarshal: ", err)
+				results.Ack(id)
+				continue
+			}
+			// Page is kept in outbox, so it's resent after reconnect
+			done := func(err error) {
+				if err != nil {
+					err = results.Nack(id)
+				} else if err = results.Ack(id); err == nil && res.Status == models.JobOk {
+					err = ledger.Earn(1)
+				}
+				if err != nil {
+					log.Print("Push: ", err)
+				}
+			}
+			if res.Status == models.JobOk && res.HTML == "" {
+				res.Status = models.JobFailed
+				res.Reason = models.ERR_EMPTY_RESULT.Error()
+			}
+			if res.Status == models.JobFailed {
+				if err := pushFailed(conn, outbox, res, done); err != nil {
+					return err
+				}
+				continue
+			}
 			data := models.DataResponseCachedPage{
-				URL:  res.Url,
-				HTML: res.HTML,
+				URL:    res.Url,
+				HTML:   res.HTML,
+				Device: res.Device.Name,
+				Peer:   appID,
 			}
-			dBytes, err := json.Marshal(data)
-			if err != nil {
-				return errors.Wrap(err, "Push: json.Marshal:")
+			// Don't send side outputs to server which would drop them
+			proto := conn.Protocol()
+			if proto.Can(models.CAP_SCREENSHOT) {
+				data.Screenshot = res.Screenshot
+			}
+			if proto.Can(models.CAP_PDF) {
+				data.PDF = res.PDF
 			}
+			// Owner verifies that page is rendered by us
+			Sign(&data, key)
 			msg := models.WSMessage{
 				Type:    models.TypeResponseCachedPage,
-				Message: res.Url,        // URL of crawled page
-				AppID:   res.AppID,      // Job token
-				Data:    string(dBytes), // Bytes of custom payload
+				Message: res.Url,   // URL of crawled page
+				AppID:   res.AppID, // Job token
+				Page:    &data,     // Encoded into payload by codec of connection
 			}
-			b, err := json.Marshal(msg)
-			if err != nil {
-				return errors.Wrap(err, "Push: json.Marshal:")
-			}
-			err = conn.WriteMessage(websocket.BinaryMessage, b)
-			if err != nil {
-				return errors.Wrap(err, "Push: write:")
+			if err := outbox.Send(conn, msg, done); err != nil {
+				return errors.Wrap(err, "Push: send:")
 			}
 		}
 	}
 }
+
+// Report job which can't be done, so server gives it to other peer
+func pushFailed(conn *models.WSConn, outbox *Outbox, res models.JobResult, done func(error)) error {
+	// Old server would take any result as page
+	if !conn.Protocol().Supports(models.TypeResponseJobFailed) {
+		log.Print("Push: failed job isn't reported: ", res.Url, ": ", res.Reason)
+		done(nil)
+		return nil
+	}
+	msg := models.WSMessage{
+		Type:    models.TypeResponseJobFailed,
+		Message: res.Url,
+		AppID:   res.AppID,
+		Token:   res.Token,
+		Error:   res.Reason,
+	}
+	if err := outbox.Send(conn, msg, done); err != nil {
+		return errors.Wrap(err, "pushFailed: send:")
+	}
+	return nil
+}
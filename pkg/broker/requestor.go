@@ -1,19 +1,21 @@
 package broker
 
 import (
-	"encoding/json"
+	"strconv"
 	"time"
 
 	"github.com/c12o16h1/shender/pkg/models"
-	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
 /*
-Requests new URLS to crawl
+Requests new URLS to crawl.
+If server supports batches, as many URLs as queue can take are requested at once,
+if it supports notifications, next request is sent once server has URLs.
  */
-func Request(conn *models.WSConn, jobsCh chan models.Job, sleeperChan <-chan time.Duration) error {
-	jobsEmptyTrigger := cap(jobsCh) / 2
+func Request(conn *models.WSConn, jobs *JobQueue, notifier *Notifier, sleeperChan <-chan time.Duration) error {
+	jobsEmptyTrigger := jobs.Cap() / 2
+	proto := conn.Protocol()
 	// Request new urls to crawl
 	for {
 		select {
@@ -22,17 +24,19 @@ func Request(conn *models.WSConn, jobsCh chan models.Job, sleeperChan <-chan tim
 			time.Sleep(sleepTime)
 		default:
 			// If we have not enough URL to crawl
-			if len(jobsCh) < jobsEmptyTrigger {
+			if jobs.Len() < jobsEmptyTrigger {
 				msg := models.WSMessage{
 					Type: models.TypeRequestGetUrls,
 				}
-				b, err := json.Marshal(msg)
-				if err != nil {
-					return errors.Wrap(err, "Request: json.Marshal:")
+				if proto.Can(models.CAP_BATCH) {
+					msg.Type = models.TypeRequestGetUrlsN
+					msg.Message = strconv.Itoa(jobs.Cap() - jobs.Len())
 				}
-				err = conn.WriteMessage(websocket.BinaryMessage, b)
-				if err != nil {
-					return errors.Wrap(err, "Request: write:")
+				if err := conn.Send(msg); err != nil {
+					return errors.Wrap(err, "Request: send:")
+				}
+				if proto.Can(models.CAP_NOTIFY) {
+					waitNotify(conn, notifier.URLs())
 				}
 			}
 		}
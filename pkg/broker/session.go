@@ -0,0 +1,333 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/config"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	HEADER_APP_ID    = "X-Shender-App-ID"
+	HEADER_ENCODINGS = "X-Shender-Encodings" // Encodings supported by broker, in order of preference
+	HEADER_ENCODING  = "X-Shender-Encoding"  // Encoding chosen by server, JSON if it's absent
+
+	WS_AUTH_TIMEOUT       = 10 * time.Second // Max time for auth handshake with server
+	WS_HELLO_TIMEOUT      = 10 * time.Second // Max time for server to answer hello
+	WS_AUTH_RETRY_TIMEOUT = 5 * time.Minute  // Pause before next attempt when credentials are rejected
+
+	ERR_NO_CREDENTIALS = models.Error("Neither app secret nor token is configured")
+	ERR_AUTH_REJECTED  = models.Error("Server rejected credentials")
+	ERR_AUTH_PROTOCOL  = models.Error("Unexpected message during auth handshake")
+	ERR_INVALID_CA     = models.Error("No certificates in CA file")
+	ERR_UNKNOWN_CODEC  = models.Error("Server chose unknown encoding")
+)
+
+/*
+Dial connects to server and authenticates this app.
+App ID and token are sent in headers of upgrade request,
+then server sends challenge, which is answered with HMAC of app secret.
+Encoding of messages is negotiated in headers too, handshake itself is always JSON.
+Then hellos are exchanged to negotiate protocol version and capabilities.
+Connection is returned only when server accepted credentials,
+or server doesn't authenticate apps at all.
+*/
+func Dial(main *config.MainConfig, app *config.AppConfig) (*models.WSConn, error) {
+	if app.Secret == "" && app.Token == "" {
+		return nil, ERR_NO_CREDENTIALS
+	}
+	dialer, err := newDialer(main)
+	if err != nil {
+		return nil, err
+	}
+	u := url.URL{Scheme: "ws", Host: main.WSHost}
+	if main.WSTLS {
+		u.Scheme = "wss"
+	}
+	h := http.Header{}
+	h.Set(HEADER_APP_ID, app.ID)
+	if app.Token != "" {
+		h.Set("Authorization", "Bearer "+app.Token)
+	}
+	h.Set(HEADER_ENCODINGS, strings.Join(main.WSEncodings, ","))
+
+	ws, resp, err := dialer.Dial(u.String(), h)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return nil, ERR_AUTH_REJECTED
+		}
+		return nil, errors.Wrap(err, "Dial: dialer.Dial:")
+	}
+	models.PrepareWSConn(ws)
+	// Old servers don't negotiate and speak JSON
+	codec := models.Codec(models.JSONCodec{})
+	if enc := resp.Header.Get(HEADER_ENCODING); enc != "" {
+		c, ok := models.Codecs[enc]
+		if !ok {
+			ws.Close()
+			return nil, errors.Wrap(ERR_UNKNOWN_CODEC, enc)
+		}
+		codec = c
+	}
+	hs := &handshake{ws: ws}
+	if err := authenticate(hs, app); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	proto, err := hello(hs, codec, LocalHello(main))
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	conn := models.NewWSConn(ws, codec, proto)
+	conn.SetPending(hs.pending())
+	return conn, nil
+}
+
+/*
+Reader of connection during handshake.
+Read deadline would break connection, so messages are read aside
+and server which says nothing is waited for with timeout.
+Messages which aren't part of handshake are kept and handed to connection, so they aren't lost.
+*/
+type handshake struct {
+	ws      *websocket.Conn
+	reading chan models.ReadResult // Read in progress, if any
+	kept    []models.ReadResult
+}
+
+// Next message from server, false if it didn't come in time, then it's still awaited
+func (h *handshake) next(timeout time.Duration) (models.ReadResult, bool) {
+	if h.reading == nil {
+		h.reading = make(chan models.ReadResult, 1)
+		go func(ws *websocket.Conn, c chan<- models.ReadResult) {
+			t, b, err := ws.ReadMessage()
+			c <- models.ReadResult{Type: t, Data: b, Err: err}
+		}(h.ws, h.reading)
+	}
+	select {
+	case r := <-h.reading:
+		h.reading = nil
+		return r, true
+	case <-time.After(timeout):
+		return models.ReadResult{}, false
+	}
+}
+
+// Keep message for connection
+func (h *handshake) keep(r models.ReadResult) {
+	h.kept = append(h.kept, r)
+}
+
+// Kept messages and then read in progress, in order they came, nil if there are none
+func (h *handshake) pending() <-chan models.ReadResult {
+	if len(h.kept) == 0 && h.reading == nil {
+		return nil
+	}
+	c := make(chan models.ReadResult, len(h.kept)+1)
+	for _, r := range h.kept {
+		c <- r
+	}
+	if h.reading == nil {
+		close(c)
+		return c
+	}
+	go func(reading <-chan models.ReadResult) {
+		c <- <-reading
+		close(c)
+	}(h.reading)
+	return c
+}
+
+/*
+Answer challenges of server until it accepts or rejects credentials.
+Servers which don't authenticate say nothing or send other message first,
+then it's kept and hellos are exchanged right away.
+*/
+func authenticate(hs *handshake, app *config.AppConfig) error {
+	for first := true; ; first = false {
+		r, ok := hs.next(WS_AUTH_TIMEOUT)
+		if !ok {
+			if first {
+				return nil
+			}
+			return errors.Wrap(ERR_AUTH_PROTOCOL, "authenticate: timeout:")
+		}
+		if r.Err != nil {
+			return errors.Wrap(r.Err, "authenticate: read:")
+		}
+		var m models.WSMessage
+		// Message which isn't JSON isn't part of auth
+		if err := json.Unmarshal(r.Data, &m); err != nil {
+			m = models.WSMessage{}
+		}
+		switch m.Type {
+		case models.TypeOk:
+			return nil
+		case models.TypeError:
+			if m.Code == models.CodeAuthFailed {
+				return ERR_AUTH_REJECTED
+			}
+			return errors.Wrap(models.Error(m.Error), "authenticate:")
+		case models.TypeAuthChallenge:
+			// Token-only apps can't answer challenge
+			if app.Secret == "" {
+				return ERR_NO_CREDENTIALS
+			}
+			resp, err := json.Marshal(models.WSMessage{
+				Type:  models.TypeAuthResponse,
+				AppID: app.ID,
+				Data:  AuthDigest(app.ID, app.Secret, m.Data),
+			})
+			if err != nil {
+				return errors.Wrap(err, "authenticate: json.Marshal:")
+			}
+			hs.ws.SetWriteDeadline(time.Now().Add(WS_AUTH_TIMEOUT))
+			if err := hs.ws.WriteMessage(websocket.BinaryMessage, resp); err != nil {
+				return errors.Wrap(err, "authenticate: write:")
+			}
+			hs.ws.SetWriteDeadline(time.Time{})
+		default:
+			// Server which doesn't authenticate speaks already
+			if first {
+				hs.keep(r)
+				return nil
+			}
+			return ERR_AUTH_PROTOCOL
+		}
+	}
+}
+
+// Hello of this broker
+func LocalHello(main *config.MainConfig) models.Hello {
+	h := models.Hello{
+		Protocol:  models.PROTOCOL_VERSION,
+		Version:   Version,
+		Encodings: main.WSEncodings,
+		Capabilities: []string{
+			models.CAP_ACKS,
+			models.CAP_SIGNATURES,
+			models.CAP_DEVICES,
+			models.CAP_SCREENSHOT,
+			models.CAP_PDF,
+			models.CAP_BATCH,
+			models.CAP_NOTIFY,
+			models.CAP_PUSH,
+			models.CAP_CREDITS,
+			models.CAP_URL_STATE,
+		},
+		Types: []models.WSType{
+			models.TypeHello,
+			models.TypeRequestSendURL,
+			models.TypeRequestSendURLs,
+			models.TypeRequestGetUrls,
+			models.TypeResponseGetUrls,
+			models.TypeRequestGetUrlsN,
+			models.TypeResponseGetUrlsN,
+			models.TypeRequestCachedPage,
+			models.TypeResponseCachedPage,
+			models.TypeResponseCachedN,
+			models.TypeResponseJobFailed,
+			models.TypeNotify,
+			models.TypeURLState,
+			models.TypeRequestBalance,
+			models.TypeResponseBalance,
+			models.TypeRegisterKey,
+			models.TypeRequestPeerKey,
+			models.TypeResponsePeerKey,
+			models.TypeReportPeer,
+			models.TypeError,
+			models.TypeOk,
+		},
+	}
+	for name := range models.Devices {
+		h.Devices = append(h.Devices, name)
+	}
+	sort.Strings(h.Devices)
+	return h
+}
+
+// Exchange hellos and negotiate protocol.
+// Servers which don't know hello speak first protocol: they answer it with error,
+// ignore it and send something else, or say nothing. Their message isn't lost,
+// it's kept by handshake for connection.
+func hello(hs *handshake, codec models.Codec, local models.Hello) (models.Protocol, error) {
+	b, err := json.Marshal(local)
+	if err != nil {
+		return models.Protocol{}, errors.Wrap(err, "hello: json.Marshal:")
+	}
+	msg, err := codec.Marshal(models.WSMessage{Type: models.TypeHello, Data: string(b)})
+	if err != nil {
+		return models.Protocol{}, errors.Wrap(err, "hello: codec.Marshal:")
+	}
+	hs.ws.SetWriteDeadline(time.Now().Add(WS_HELLO_TIMEOUT))
+	if err := hs.ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+		return models.Protocol{}, errors.Wrap(err, "hello: write:")
+	}
+	hs.ws.SetWriteDeadline(time.Time{})
+
+	r, ok := hs.next(WS_HELLO_TIMEOUT)
+	if !ok {
+		return models.LegacyProtocol(), nil
+	}
+	if r.Err != nil {
+		return models.Protocol{}, errors.Wrap(r.Err, "hello: read:")
+	}
+	var m models.WSMessage
+	if err := codec.Unmarshal(r.Data, &m); err != nil {
+		// It's not hello, so it's handled by connection as any other message
+		hs.keep(r)
+		return models.LegacyProtocol(), nil
+	}
+	switch m.Type {
+	case models.TypeHello:
+		var server models.Hello
+		if err := json.Unmarshal([]byte(m.Data), &server); err != nil {
+			return models.Protocol{}, errors.Wrap(err, "hello: json.Unmarshal:")
+		}
+		return models.Negotiate(local, server)
+	case models.TypeError:
+		return models.LegacyProtocol(), nil
+	}
+	hs.keep(r)
+	return models.LegacyProtocol(), nil
+}
+
+// Answer to challenge of server, hex of HMAC-SHA256 of app ID and nonce
+func AuthDigest(appID string, secret string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(appID + "\n" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dialer with custom CA, if it's configured
+func newDialer(main *config.MainConfig) (*websocket.Dialer, error) {
+	d := *websocket.DefaultDialer
+	if main.WSCAFile == "" {
+		return &d, nil
+	}
+	pem, err := ioutil.ReadFile(main.WSCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "newDialer: ioutil.ReadFile:")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ERR_INVALID_CA
+	}
+	d.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &d, nil
+}
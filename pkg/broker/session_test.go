@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/c12o16h1/shender/pkg/config"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+// Legacy server doesn't authenticate and doesn't know hello
+func TestDialWithoutAuth(t *testing.T) {
+	up := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := up.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		send := func(m models.WSMessage) {
+			b, _ := json.Marshal(m)
+			ws.WriteMessage(websocket.TextMessage, b)
+		}
+		send(models.WSMessage{Type: models.TypeNotify, Message: models.NotifyCache})
+		ws.ReadMessage() // Hello
+		send(models.WSMessage{Type: models.TypeError, Error: "unknown type"})
+		ws.ReadMessage()
+	}))
+	defer srv.Close()
+
+	main := &config.MainConfig{WSHost: strings.TrimPrefix(srv.URL, "http://")}
+	conn, err := Dial(main, &config.AppConfig{ID: "app", Token: "token"})
+	if err != nil {
+		t.Fatalf("Can't dial: %s", err)
+	}
+	defer conn.Close()
+	if conn.Protocol().Can(models.CAP_ACKS) {
+		t.Fatal("Expected legacy protocol")
+	}
+	// First message of server isn't lost
+	m, err := conn.Receive()
+	if err != nil || m.Type != models.TypeNotify {
+		t.Fatalf("Expected notification, got %+v, %v", m, err)
+	}
+}
@@ -3,39 +3,54 @@ package broker
 import (
 	"encoding/json"
 	"log"
+	"strconv"
 	"time"
 
 	"github.com/c12o16h1/shender/pkg/cache"
 	"github.com/c12o16h1/shender/pkg/models"
-	"github.com/gorilla/websocket"
+	"github.com/c12o16h1/shender/pkg/processor"
 	"github.com/pkg/errors"
 )
 
+const (
+	QUARANTINE_TTL = 7 * 24 * time.Hour // How long suspicious pages are kept for investigation
+	STORAGE_PAUSE  = 10 * time.Second   // Pages aren't requested for this time after storage failed
+)
+
 /*
-RequestCache requests new URLs to crawl
+RequestCache requests cached pages of this app.
+Server which pushes pages is asked only once after connect,
+to reconcile pages rendered while broker was disconnected.
+If server supports batches, many pages are requested at once,
+if it supports notifications, next request is sent once server has pages.
+Requests are paused while pages can't be stored.
  */
-func RequestCache(conn *models.WSConn, appID string, sleeperChan <-chan time.Duration, renewWS chan<- int) error {
-	// Request new urls to crawl
+func RequestCache(conn *models.WSConn, appID string, notifier *Notifier, sleeperChan <-chan time.Duration, storagePause <-chan time.Duration) error {
+	proto := conn.Protocol()
+	if proto.Can(models.CAP_PUSH) {
+		return reconcile(conn, appID, notifier, sleeperChan, storagePause)
+	}
+	// Request cached pages
 	for {
 		select {
 		case sleepTime := <-sleeperChan:
 			// Sleep
 			time.Sleep(sleepTime)
+		case sleepTime := <-storagePause:
+			time.Sleep(sleepTime)
 		default:
 			msg := models.WSMessage{
 				Type:  models.TypeRequestCachedPage,
 				AppID: appID,
 			}
-			b, err := json.Marshal(msg)
-			if err != nil {
-				return errors.Wrap(err, "RequestCache: json.Marshal:")
+			if proto.Can(models.CAP_BATCH) {
+				msg.Message = strconv.Itoa(CACHE_BATCH_SIZE)
 			}
-			err = conn.WriteMessage(websocket.BinaryMessage, b)
-			if err != nil {
-				// ASk to renew WS connection
-				log.Print("RENEW WS")
-				renewWS <- 0
-				return errors.Wrap(err, "RequestCache: write:")
+			if err := conn.Send(msg); err != nil {
+				return errors.Wrap(err, "RequestCache: send:")
+			}
+			if proto.Can(models.CAP_NOTIFY) {
+				waitNotify(conn, notifier.Cache())
 			}
 		}
 		time.Sleep(WS_BUMP_TIMEOUT)
@@ -43,14 +58,219 @@ func RequestCache(conn *models.WSConn, appID string, sleeperChan <-chan time.Dur
 }
 
 /*
-Storing cache in local cache DB
+Ask server for pages which weren't pushed, batch after batch,
+until server answers it has nothing pending (error 430) or doesn't answer at all,
+then wait until connection is closed. Failure of storage only pauses it.
+*/
+func reconcile(conn *models.WSConn, appID string, notifier *Notifier, sleeperChan <-chan time.Duration, storagePause <-chan time.Duration) error {
+	msg := models.WSMessage{
+		Type:  models.TypeRequestCachedPage,
+		AppID: appID,
+	}
+	if conn.Protocol().Can(models.CAP_BATCH) {
+		msg.Message = strconv.Itoa(CACHE_BATCH_SIZE)
+	}
+	// Pause asked on previous connection doesn't mean nothing is pending now
+	for len(sleeperChan) > 0 {
+		<-sleeperChan
+	}
+	for pending := true; pending; {
+		if err := conn.Send(msg); err != nil {
+			return errors.Wrap(err, "reconcile: send:")
+		}
+		select {
+		case <-notifier.Cache():
+			// Got pages, there may be more
+		case <-sleeperChan:
+			pending = false
+		case sleepTime := <-storagePause:
+			time.Sleep(sleepTime)
+		case <-time.After(WS_POLL_TIMEOUT):
+			pending = false
+		case <-conn.Done():
+			return nil
+		}
+	}
+	<-conn.Done()
+	return nil
+}
+
+/*
+Storing cache in local cache DB.
+Page is removed from queue once it's processed, so it's processed again after crash.
  */
-func Storage(c *cache.Cacher, storagerCh <-chan models.DataResponseCachedPage, sleeperChan chan<- time.Duration) error {
+func Storage(
+	c *cache.Cacher,
+	keyring *Keyring,
+	ledger *Ledger,
+	tracker *cache.Tracker,
+	sanitizer *processor.Sanitizer,
+	verifier *Verifier,
+	chain *processor.Chain,
+	storager *cache.Queue,
+	sleeperChan chan<- time.Duration,
+) error {
 	for {
-		ch := <-storagerCh
-		if err := (*c).Set([]byte(ch.URL), []byte(ch.HTML)); err != nil {
-			sleeperChan <- 0 // Pause receiving of new cache
-			return errors.Wrap(err, "Storage: (*c).Set:")
+		id, b, err := storager.Pop()
+		if err != nil {
+			return errors.Wrap(err, "Storage: storager.Pop:")
+		}
+		var ch models.DataResponseCachedPage
+		if err := json.Unmarshal(b, &ch); err != nil {
+			log.Print(ERR_INVALID_CACHE)
+			storager.Ack(id)
+			continue
+		}
+		if err := store(*c, keyring, ledger, tracker, sanitizer, verifier, chain, ch); err != nil {
+			// Page is processed again later
+			if err := storager.Nack(id); err != nil {
+				log.Print(err)
+			}
+			// Pause receiving of new cache, unless it's paused already
+			select {
+			case sleeperChan <- STORAGE_PAUSE:
+			default:
+			}
+			return err
+		}
+		if err := storager.Ack(id); err != nil {
+			return errors.Wrap(err, "Storage:")
 		}
 	}
 }
+
+// Validate page and store it, pages which don't pass are dropped
+func store(
+	c cache.Cacher,
+	keyring *Keyring,
+	ledger *Ledger,
+	tracker *cache.Tracker,
+	sanitizer *processor.Sanitizer,
+	verifier *Verifier,
+	chain *processor.Chain,
+	ch models.DataResponseCachedPage,
+) error {
+	key := models.CacheKey(ch.URL, ch.Device)
+	// Only pages signed by registered peers are accepted
+	if err := keyring.Check(ch); err != nil {
+		// Key may be still on its way from server, so page is checked again later
+		if err == ERR_UNKNOWN_PEER {
+			return errors.Wrap(err, "store: "+ch.Peer+":")
+		}
+		log.Print("Storage: ", ch.URL, ": ", ch.Peer, ": ", err)
+		// Forged page is kept aside for investigation
+		if err == ERR_INVALID_SIGNATURE {
+			if err := quarantine(c, key, ch, err); err != nil {
+				log.Print(err)
+			}
+		}
+		return nil
+	}
+	// Page is rendered by other member, so it's untrusted.
+	// Suspicious pages are kept aside for investigation, but never served.
+	body, err := sanitizer.Sanitize(ch.URL, ch.HTML)
+	if err != nil {
+		log.Print("Storage: quarantine: ", ch.URL, ": ", err)
+		if err := quarantine(c, key, ch, err); err != nil {
+			log.Print(err)
+		}
+		// Signature proves that peer sent page which pretends to be other site
+		if err == processor.ERR_FOREIGN_PAGE || err == processor.ERR_CANONICAL_MISMATCH {
+			keyring.Ban(ch.Peer, err.Error())
+		}
+		markFailed(tracker, key, err)
+		return nil
+	}
+	// Wait until enough peers rendered same content
+	ch.HTML = body
+	ch, ok := verifier.Verify(key, ch)
+	if !ok {
+		return nil
+	}
+	// Post-process page, pages which don't pass are dropped
+	body, err = chain.Process(ch.URL, ch.HTML)
+	if err != nil {
+		log.Print("Storage: ", ch.URL, ": ", err)
+		markFailed(tracker, key, err)
+		return nil
+	}
+	if err := c.Set([]byte(key), []byte(body)); err != nil {
+		return errors.Wrap(err, "store: c.Set:")
+	}
+	if err := tracker.Mark(key, models.URLCached, ""); err != nil {
+		log.Print(err)
+	}
+	// Peer rendered page for us, page processed again after failure isn't paid twice
+	if err := ledger.Spend(models.ContentHash(ch.Signature)); err != nil {
+		log.Print(err)
+	}
+	if err := provenance(c, key, ch); err != nil {
+		log.Print(err)
+	}
+	// Side outputs are stored next to page
+	if len(ch.Screenshot) > 0 {
+		if err := c.Set([]byte(models.PREFIX_SCREENSHOT+key), ch.Screenshot); err != nil {
+			return errors.Wrap(err, "store: c.Set:")
+		}
+	}
+	if len(ch.PDF) > 0 {
+		if err := c.Set([]byte(models.PREFIX_PDF+key), ch.PDF); err != nil {
+			return errors.Wrap(err, "store: c.Set:")
+		}
+	}
+	return nil
+}
+
+// Page is rejected, it's enqueued again after backoff
+func markFailed(tracker *cache.Tracker, key string, reason error) {
+	if err := tracker.Mark(key, models.URLFailed, reason.Error()); err != nil {
+		log.Print(err)
+	}
+}
+
+// Suspicious page with reason why it's rejected
+type quarantined struct {
+	models.DataResponseCachedPage
+	Reason   string    `json:"reason"`
+	Received time.Time `json:"received"`
+}
+
+// Keep suspicious page aside from cache
+func quarantine(c cache.Cacher, key string, page models.DataResponseCachedPage, reason error) error {
+	b, err := json.Marshal(quarantined{
+		DataResponseCachedPage: page,
+		Reason:                 reason.Error(),
+		Received:               time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "quarantine: json.Marshal:")
+	}
+	if err := c.Setex([]byte(models.PREFIX_QUARANTINE+key), QUARANTINE_TTL, b); err != nil {
+		return errors.Wrap(err, "quarantine: c.Setex:")
+	}
+	return nil
+}
+
+// Record who rendered cached page, so bad pages may be traced to peer
+type provenanceRecord struct {
+	Peer      string `json:"peer"`
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature"`
+}
+
+func provenance(c cache.Cacher, key string, page models.DataResponseCachedPage) error {
+	b, err := json.Marshal(provenanceRecord{
+		Peer:      page.Peer,
+		Hash:      page.Hash,
+		Timestamp: page.Timestamp,
+		Signature: page.Signature,
+	})
+	if err != nil {
+		return errors.Wrap(err, "provenance: json.Marshal:")
+	}
+	if err := c.Set([]byte(models.PREFIX_PROVENANCE+key), b); err != nil {
+		return errors.Wrap(err, "provenance: c.Set:")
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/config"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	WORKER_START_TIMEOUT      = 10 * time.Second       // Max time for worker to bind and report readiness
+	WORKER_STOP_TIMEOUT       = 5 * time.Second        // Max time for worker to close chrome and exit
+	WORKER_LIFETIME_MARGIN    = 10 * time.Second       // Worker lives this long after render timeout, anything older is hung
+	WORKER_HEARTBEAT_INTERVAL = 5 * time.Second        // How often supervisor checks alive workers
+	WORKER_HEARTBEAT_TIMEOUT  = 3 * time.Second        // Max time to wait for heartbeat reply
+	WORKER_READY_POLL         = 100 * time.Millisecond // Pause between readiness checks
+	WORKER_SPAWN_ATTEMPTS     = 2                      // Attempts to spawn replacement for worker which failed to start
+	RENDER_TIMEOUT_GRACE      = 2 * time.Second        // Time for worker to report own timeout before it's killed
+
+	ERR_WORKER_NOT_READY = models.Error("Worker didn't report readiness")
+	ERR_WORKER_HANDSHAKE = models.Error("Invalid worker handshake")
+	ERR_WORKER_EXITED    = models.Error("Worker exited")
+)
+
+// Process is a running render worker
+type Process struct {
+	Pid     int
+	Network string
+	Addr    string
+	Client  *rpc.Client
+
+	cmd     *exec.Cmd
+	started time.Time
+	stopped bool          // Stopped by supervisor, so exit is expected
+	done    chan struct{} // Closed when process is reaped
+}
+
+// Supervisor spawns render workers and keeps track of them,
+// so crashed workers are reaped and hung workers are killed
+type Supervisor struct {
+	cfg *config.RenderConfig
+
+	mtx   sync.Mutex
+	procs map[int]*Process // Alive workers by PID
+	seq   int              // Sequence for unix socket names
+}
+
+// Creates new supervisor for render workers
+func NewSupervisor(cfg *config.RenderConfig) *Supervisor {
+	return &Supervisor{
+		cfg:   cfg,
+		procs: make(map[int]*Process),
+	}
+}
+
+// Spawn starts new render worker and waits until it's ready to accept jobs.
+// Worker which failed to start is killed and replaced by a new one.
+func (s *Supervisor) Spawn() (*Process, error) {
+	var err error
+	for i := 0; i < WORKER_SPAWN_ATTEMPTS; i++ {
+		var p *Process
+		if p, err = s.spawn(); err == nil {
+			return p, nil
+		}
+		log.Print("Spawn: ", err)
+	}
+	return nil, err
+}
+
+func (s *Supervisor) spawn() (*Process, error) {
+	cmd := exec.Command(s.cfg.Bin, s.args()...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "spawn: cmd.StdoutPipe:")
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "spawn: cmd.Start:")
+	}
+
+	p := &Process{
+		Pid:     cmd.Process.Pid,
+		cmd:     cmd,
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	s.mtx.Lock()
+	s.procs[p.Pid] = p
+	s.mtx.Unlock()
+
+	// Worker reports bound address once listening
+	lines := make(chan string, 1)
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		r := bufio.NewReader(stdout)
+		line, _ := r.ReadString('\n')
+		lines <- line
+		// Drain the rest, so worker never blocks on writing to stdout
+		io.Copy(ioutil.Discard, r)
+	}()
+	go s.reap(p, read)
+
+	select {
+	case line := <-lines:
+		network, addr, err := parseHandshake(line)
+		if err != nil {
+			s.Kill(p)
+			return nil, err
+		}
+		s.mtx.Lock()
+		p.Network, p.Addr = network, addr
+		s.mtx.Unlock()
+	case <-p.done:
+		return nil, ERR_WORKER_EXITED
+	case <-time.After(WORKER_START_TIMEOUT):
+		s.Kill(p)
+		return nil, ERR_WORKER_NOT_READY
+	}
+
+	if err := s.waitReady(p); err != nil {
+		s.Kill(p)
+		return nil, err
+	}
+	return p, nil
+}
+
+// Wait for successful heartbeat from freshly started worker
+func (s *Supervisor) waitReady(p *Process) error {
+	deadline := time.Now().Add(WORKER_START_TIMEOUT)
+	for time.Now().Before(deadline) {
+		select {
+		case <-p.done:
+			return ERR_WORKER_EXITED
+		default:
+		}
+		c, err := rpc.Dial(p.Network, p.Addr)
+		if err != nil {
+			time.Sleep(WORKER_READY_POLL)
+			continue
+		}
+		if heartbeat(c) == nil {
+			s.mtx.Lock()
+			p.Client = c
+			s.mtx.Unlock()
+			return nil
+		}
+		c.Close()
+		time.Sleep(WORKER_READY_POLL)
+	}
+	return ERR_WORKER_NOT_READY
+}
+
+// Wait for worker exit and forget about it.
+// Wait closes stdout, so it's called only once stdout is read to the end.
+func (s *Supervisor) reap(p *Process, read <-chan struct{}) {
+	<-read
+	err := p.cmd.Wait()
+
+	s.mtx.Lock()
+	delete(s.procs, p.Pid)
+	stopped := p.stopped
+	c := p.Client
+	network, addr := p.Network, p.Addr
+	s.mtx.Unlock()
+
+	if c != nil {
+		c.Close()
+	}
+	if network == "unix" {
+		os.Remove(addr)
+	}
+	if !stopped {
+		log.Printf("Worker %d exited unexpectedly: %v", p.Pid, err)
+	}
+	close(p.done)
+}
+
+// Render page with new worker, it's stopped once page is rendered
+func (s *Supervisor) Render(ctx context.Context, req models.RenderRequest) (models.RenderResult, error) {
+	// Spawn worker for this task, it's ready to render once returned
+	p, err := s.Spawn()
+	if err != nil {
+		return models.RenderResult{}, err
+	}
+	// Close worker, kill chrome etc
+	defer s.Stop(p)
+	log.Print("Worker ", p.Pid, ": ", req.URL)
+	return s.call(ctx, p, req)
+}
+
+// Call worker to render page and wait for result until deadline.
+// Worker cancels render by itself on timeout, but if it's hung it's killed.
+func (s *Supervisor) call(ctx context.Context, p *Process, req models.RenderRequest) (models.RenderResult, error) {
+	var res models.RenderResult
+	call := p.Client.Go("Worker.Render", req, &res, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			// Errors are passed via RPC as strings
+			if call.Error.Error() == models.ERR_RENDER_TIMEOUT.Error() {
+				return models.RenderResult{}, models.ERR_RENDER_TIMEOUT
+			}
+			return models.RenderResult{}, call.Error
+		}
+		return res, nil
+	case <-time.After(req.Timeout + RENDER_TIMEOUT_GRACE):
+		s.Kill(p)
+		return models.RenderResult{}, models.ERR_RENDER_TIMEOUT
+	case <-ctx.Done():
+		s.Kill(p)
+		return models.RenderResult{}, ctx.Err()
+	}
+}
+
+// Stop asks worker to close chrome and exit, kills them if they don't
+func (s *Supervisor) Stop(p *Process) {
+	s.mtx.Lock()
+	p.stopped = true
+	c := p.Client
+	s.mtx.Unlock()
+
+	if c != nil {
+		// Worker exits in the middle of call, so there is no reply to wait for
+		c.Go("Worker.Close", 0, new(string), nil)
+	}
+	select {
+	case <-p.done:
+	case <-time.After(WORKER_STOP_TIMEOUT):
+		s.Kill(p)
+	}
+}
+
+// Kill worker process immediately
+func (s *Supervisor) Kill(p *Process) {
+	s.mtx.Lock()
+	p.stopped = true
+	s.mtx.Unlock()
+	p.cmd.Process.Kill()
+}
+
+// Watch periodically checks all workers and kills hung ones
+func (s *Supervisor) Watch() {
+	for {
+		time.Sleep(WORKER_HEARTBEAT_INTERVAL)
+
+		s.mtx.Lock()
+		var procs []*Process
+		for _, p := range s.procs {
+			procs = append(procs, p)
+		}
+		s.mtx.Unlock()
+
+		for _, p := range procs {
+			if time.Since(p.started) > s.lifetime()+WORKER_STOP_TIMEOUT {
+				log.Printf("Worker %d is hung, killing", p.Pid)
+				s.Kill(p)
+				continue
+			}
+			s.mtx.Lock()
+			c := p.Client
+			s.mtx.Unlock()
+			// Worker still starting
+			if c == nil {
+				continue
+			}
+			if err := heartbeat(c); err != nil {
+				log.Printf("Worker %d heartbeat failed, killing: %v", p.Pid, err)
+				s.Kill(p)
+			}
+		}
+	}
+}
+
+// Shutdown kills all workers
+func (s *Supervisor) Shutdown() {
+	s.mtx.Lock()
+	var procs []*Process
+	for _, p := range s.procs {
+		procs = append(procs, p)
+	}
+	s.mtx.Unlock()
+
+	for _, p := range procs {
+		s.Kill(p)
+	}
+}
+
+// Command line for worker, it listens on next address and runs Chrome with configured options
+func (s *Supervisor) args() []string {
+	args := []string{
+		"-network", s.cfg.Network,
+		"-addr", s.nextAddr(),
+		"-lifetime", s.lifetime().String(),
+		"-headless=" + strconv.FormatBool(s.cfg.Headless),
+		"-no-sandbox=" + strconv.FormatBool(s.cfg.NoSandbox),
+		"-disable-gpu=" + strconv.FormatBool(s.cfg.DisableGPU),
+		"-window-size", fmt.Sprintf("%d,%d", s.cfg.WindowWidth, s.cfg.WindowHeight),
+	}
+	if s.cfg.ChromeBin != "" {
+		args = append(args, "-chrome-bin", s.cfg.ChromeBin)
+	}
+	if s.cfg.Proxy != "" {
+		args = append(args, "-proxy", s.cfg.Proxy)
+	}
+	if s.cfg.UserDataDir != "" {
+		args = append(args, "-user-data-dir", s.cfg.UserDataDir)
+	}
+	if len(s.cfg.ChromeFlags) > 0 {
+		args = append(args, "-chrome-flags", strings.Join(s.cfg.ChromeFlags, ","))
+	}
+	return args
+}
+
+// Worker exits by itself after this time
+func (s *Supervisor) lifetime() time.Duration {
+	return WORKER_START_TIMEOUT + s.cfg.Timeout + WORKER_LIFETIME_MARGIN
+}
+
+// Address for next worker to listen on.
+// For TCP port 0 is used, so worker picks free port by itself
+func (s *Supervisor) nextAddr() string {
+	if s.cfg.Network != "unix" {
+		return "127.0.0.1:0"
+	}
+	s.mtx.Lock()
+	s.seq++
+	seq := s.seq
+	s.mtx.Unlock()
+	return filepath.Join(os.TempDir(), fmt.Sprintf("shender-render-%d-%d.sock", os.Getpid(), seq))
+}
+
+// Check that worker is alive
+func heartbeat(c *rpc.Client) error {
+	var ok string
+	call := c.Go("Worker.Heartbeat", "", &ok, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			return call.Error
+		}
+	case <-time.After(WORKER_HEARTBEAT_TIMEOUT):
+		return ERR_WORKER_NOT_READY
+	}
+	if ok != models.OK {
+		return ERR_WORKER_NOT_READY
+	}
+	return nil
+}
+
+// Parse "LISTEN <network> <address>" line reported by worker
+func parseHandshake(line string) (string, string, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != models.RENDER_LISTEN {
+		return "", "", ERR_WORKER_HANDSHAKE
+	}
+	return fields[1], fields[2], nil
+}
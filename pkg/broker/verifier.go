@@ -0,0 +1,128 @@
+package broker
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/c12o16h1/shender/pkg/models"
+	"github.com/c12o16h1/shender/pkg/processor"
+)
+
+const (
+	VERIFY_TIMEOUT = 10 * time.Minute // Max time to wait for all peers to render page
+)
+
+/*
+Verifier cross-checks renders of same page by independent peers,
+page is stored only when quorum of them rendered same content.
+*/
+type Verifier struct {
+	replicas int // Amount of peers asked to render every page
+	quorum   int // Amount of peers which have to agree
+
+	mtx     sync.Mutex
+	pending map[string]*verification // Verifications by cache key
+}
+
+type verification struct {
+	votes    map[string]string                        // Content hash by peer
+	pages    map[string]models.DataResponseCachedPage // First page with content hash
+	started  time.Time
+	done     bool   // Quorum reached, late peers are only checked
+	accepted string // Content hash which reached quorum
+}
+
+// Create verifier, with replicas <= 1 every page is accepted as is
+func NewVerifier(replicas int, quorum int) *Verifier {
+	if quorum <= 0 || quorum > replicas {
+		quorum = replicas/2 + 1
+	}
+	return &Verifier{
+		replicas: replicas,
+		quorum:   quorum,
+		pending:  make(map[string]*verification),
+	}
+}
+
+// Verify records page rendered by peer.
+// Page is returned once quorum of peers rendered same content,
+// and again when page of agreeing peer is redelivered, f.e. after it failed to be stored.
+func (v *Verifier) Verify(key string, page models.DataResponseCachedPage) (models.DataResponseCachedPage, bool) {
+	if v.replicas <= 1 {
+		return page, true
+	}
+	hash, err := processor.ContentHash(page.URL, page.HTML)
+	if err != nil {
+		log.Print("Verify: ", page.URL, ": ", err)
+		return page, false
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	v.expire()
+
+	vr, ok := v.pending[key]
+	if !ok {
+		vr = &verification{
+			votes:   make(map[string]string),
+			pages:   make(map[string]models.DataResponseCachedPage),
+			started: time.Now(),
+		}
+		v.pending[key] = vr
+	}
+	// Every peer has one vote
+	if h, voted := vr.votes[page.Peer]; voted {
+		if vr.done && h == hash && h == vr.accepted {
+			return vr.pages[hash], true
+		}
+		return page, false
+	}
+	for peer, h := range vr.votes {
+		if h != hash {
+			log.Printf("Verify: %s: peers disagree: %s=%s, %s=%s", page.URL, peer, h, page.Peer, hash)
+			break
+		}
+	}
+	vr.votes[page.Peer] = hash
+	if _, ok := vr.pages[hash]; !ok {
+		vr.pages[hash] = page
+	}
+	if vr.done {
+		return page, false
+	}
+
+	agreed := 0
+	for _, h := range vr.votes {
+		if h == hash {
+			agreed++
+		}
+	}
+	if agreed >= v.quorum {
+		vr.done = true
+		vr.accepted = hash
+		metricVerifyAgreed.Add(1)
+		return vr.pages[hash], true
+	}
+	// Everybody reported, but there is no quorum
+	if len(vr.votes) >= v.replicas {
+		log.Printf("Verify: %s: no quorum of %d among %d peers", page.URL, v.quorum, len(vr.votes))
+		metricVerifyDisagreed.Add(1)
+		delete(v.pending, key)
+	}
+	return page, false
+}
+
+// Forget about old verifications, must be called under lock
+func (v *Verifier) expire() {
+	for k, vr := range v.pending {
+		if time.Since(vr.started) < VERIFY_TIMEOUT {
+			continue
+		}
+		if !vr.done {
+			log.Printf("Verify: %s: only %d of %d peers reported", k, len(vr.votes), v.replicas)
+			metricVerifyExpired.Add(1)
+		}
+		delete(v.pending, k)
+	}
+}
@@ -0,0 +1,34 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+func TestVerifierRedelivery(t *testing.T) {
+	v := NewVerifier(3, 2)
+	page := func(peer string, body string) models.DataResponseCachedPage {
+		return models.DataResponseCachedPage{URL: "example.com/", HTML: "<html><body>" + body + "</body></html>", Peer: peer}
+	}
+	if _, ok := v.Verify("k", page("a", "same")); ok {
+		t.Fatal("Expected no quorum after first peer")
+	}
+	if _, ok := v.Verify("k", page("b", "other")); ok {
+		t.Fatal("Expected no quorum when peers disagree")
+	}
+	p, ok := v.Verify("k", page("c", "same"))
+	if !ok || p.Peer != "a" {
+		t.Fatalf("Expected quorum with page of first peer, got %v %s", ok, p.Peer)
+	}
+
+	// Page which failed to be stored is accepted again
+	p, ok = v.Verify("k", page("c", "same"))
+	if !ok || p.Peer != "a" {
+		t.Fatalf("Expected redelivered page to be accepted, got %v %s", ok, p.Peer)
+	}
+	// Peer which disagreed still isn't
+	if _, ok := v.Verify("k", page("b", "other")); ok {
+		t.Fatal("Expected disagreeing peer not to be accepted")
+	}
+}
@@ -12,6 +12,7 @@ const (
 	//TypeRedis  = "redis"
 
 	ErrorUnknownDriver = models.Error("Unknown cache driver")
+	ErrorNotFound      = models.Error("Key not found")
 )
 
 type Cacher interface {
@@ -19,10 +20,18 @@ type Cacher interface {
 	Setex(k []byte, ttl time.Duration, v []byte) error
 	Get(k []byte) ([]byte, error)
 	Spop(prefix []byte, amount uint) ([][]byte, error)
+	Scan(prefix []byte, amount uint) ([]KV, error)
+	ScanFrom(prefix []byte, from []byte, amount uint) ([]KV, error) // Scan starting at key from, to page through prefix
 	Delete(k []byte) error
 	models.Closer
 }
 
+// Key with value, as returned by Scan
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
 func New(config *config.CacheConfig) (Cacher, error) {
 	switch config.Type {
 	case TypeBadgerDB:
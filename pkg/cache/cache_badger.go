@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"bytes"
 	"log"
 	"time"
 
@@ -29,6 +30,9 @@ func (b *BadgerDBCache) Get(k []byte) ([]byte, error) {
 	var v []byte
 	err := b.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(k)
+		if err == badger.ErrKeyNotFound {
+			return ErrorNotFound
+		}
 		if err != nil {
 			return err
 		}
@@ -53,9 +57,10 @@ func (b *BadgerDBCache) Spop(prefix []byte, amount uint) ([][]byte, error) {
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Seek(prefix); len(populated) <= int(amount) && it.ValidForPrefix(prefix); it.Next() {
+		for it.Seek(prefix); len(populated) < int(amount) && it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
-			k := item.Key()
+			// Key is reused by iterator, so it's copied
+			k := item.KeyCopy(nil)
 			if len(k) > 0 {
 				populated = append(populated, k)
 			}
@@ -79,6 +84,33 @@ func (b *BadgerDBCache) Spop(prefix []byte, amount uint) ([][]byte, error) {
 	return results, err
 }
 
+// Get up to amount keys with prefix in key order, keys are kept
+func (b *BadgerDBCache) Scan(prefix []byte, amount uint) ([]KV, error) {
+	return b.ScanFrom(prefix, prefix, amount)
+}
+
+func (b *BadgerDBCache) ScanFrom(prefix []byte, from []byte, amount uint) ([]KV, error) {
+	if bytes.Compare(from, prefix) < 0 {
+		from = prefix
+	}
+	var results []KV
+	err := b.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(from); len(results) < int(amount) && it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			// Key and value are reused by iterator, so they are copied
+			v, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			results = append(results, KV{Key: item.KeyCopy(nil), Value: v})
+		}
+		return nil
+	})
+	return results, err
+}
+
 func (b *BadgerDBCache) Delete(k []byte) error {
 	err := b.db.Update(func(txn *badger.Txn) error {
 		return txn.Delete(k)
@@ -91,9 +123,13 @@ func (b *BadgerDBCache) Close() {
 }
 
 func newBadgerDBCache() (Cacher, error) {
+	return openBadgerDBCache("./cache")
+}
+
+func openBadgerDBCache(dir string) (Cacher, error) {
 	opts := badger.DefaultOptions
-	opts.Dir = "./cache"
-	opts.ValueDir = "./cache"
+	opts.Dir = dir
+	opts.ValueDir = dir
 	db, err := badger.Open(opts)
 	if err != nil {
 		log.Fatal(err)
@@ -2,7 +2,13 @@ package cache
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
+
+	"github.com/c12o16h1/shender/pkg/models"
 )
 
 func TestNew(t *testing.T) {
@@ -10,6 +16,7 @@ func TestNew(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Can't create BadgerDB cache")
 	}
+	defer c.Close()
 
 	key := []byte("'/~`';testkey")
 	val := []byte("testvalue")
@@ -30,3 +37,207 @@ func TestNew(t *testing.T) {
 		t.Fatalf("Can't delete key")
 	}
 }
+
+// Cache in own temp dir, so tests don't see each other's keys
+func tempCache(t *testing.T) (Cacher, func()) {
+	dir, err := ioutil.TempDir("", "shender-cache")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %s", err)
+	}
+	c, err := openBadgerDBCache(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Can't create BadgerDB cache")
+	}
+	return c, func() {
+		c.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	c, done := tempCache(t)
+	defer done()
+
+	q, err := NewQueue(c, "test", 0)
+	if err != nil {
+		t.Fatalf("Can't open queue: %s", err)
+	}
+	for _, v := range []string{"first", "second"} {
+		if err := q.Push([]byte(v)); err != nil {
+			t.Fatalf("Can't push: %s", err)
+		}
+	}
+
+	// Returned item is delivered again
+	id, v, err := q.Pop()
+	if err != nil || string(v) != "first" {
+		t.Fatalf("Expected first item, got %q, %v", v, err)
+	}
+	if err := q.Nack(id); err != nil {
+		t.Fatalf("Can't nack: %s", err)
+	}
+	id, v, err = q.Pop()
+	if err != nil || string(v) != "first" {
+		t.Fatalf("Expected first item again, got %q, %v", v, err)
+	}
+	if err := q.Ack(id); err != nil {
+		t.Fatalf("Can't ack: %s", err)
+	}
+
+	// In-flight item is delivered again after restart
+	if _, v, err = q.Pop(); err != nil || string(v) != "second" {
+		t.Fatalf("Expected second item, got %q, %v", v, err)
+	}
+	q, err = NewQueue(c, "test", 0)
+	if err != nil {
+		t.Fatalf("Can't reopen queue: %s", err)
+	}
+	id, v, err = q.Pop()
+	if err != nil || string(v) != "second" {
+		t.Fatalf("Expected second item after restart, got %q, %v", v, err)
+	}
+	if err := q.Ack(id); err != nil {
+		t.Fatalf("Can't ack: %s", err)
+	}
+}
+
+func TestQueueLimits(t *testing.T) {
+	c, done := tempCache(t)
+	defer done()
+
+	q, err := NewQueue(c, "test", 2)
+	if err != nil {
+		t.Fatalf("Can't open queue: %s", err)
+	}
+	for _, v := range []string{"poison", "second"} {
+		if err := q.Push([]byte(v)); err != nil {
+			t.Fatalf("Can't push: %s", err)
+		}
+	}
+	if err := q.Push([]byte("third")); err != ErrorQueueFull {
+		t.Fatalf("Expected queue to be full, got %v", err)
+	}
+
+	// Item which keeps failing is given up, so next one is delivered
+	for i := 0; i < QUEUE_MAX_ATTEMPTS; i++ {
+		id, v, err := q.Pop()
+		if err != nil || string(v) != "poison" {
+			t.Fatalf("Expected poison item, got %q, %v", v, err)
+		}
+		if err := q.Nack(id); err != nil {
+			t.Fatalf("Can't nack: %s", err)
+		}
+	}
+	if q.Len() != 1 {
+		t.Fatalf("Expected poison item to be given up, got %d items", q.Len())
+	}
+	id, v, err := q.Pop()
+	if err != nil || string(v) != "second" {
+		t.Fatalf("Expected second item, got %q, %v", v, err)
+	}
+	// Duplicate ack doesn't free space
+	q.Ack(id)
+	q.Ack(id)
+	if q.Len() != 0 {
+		t.Fatalf("Expected empty queue, got %d items", q.Len())
+	}
+	if dead, _ := c.Scan([]byte(q.dead), 10); len(dead) != 1 || string(dead[0].Value) != "poison" {
+		t.Fatalf("Expected poison item in dead letters, got %v", dead)
+	}
+
+	// Size survives restart
+	if err := q.Push([]byte("third")); err != nil {
+		t.Fatalf("Can't push: %s", err)
+	}
+	q, err = NewQueue(c, "test", 2)
+	if err != nil || q.Len() != 1 {
+		t.Fatalf("Expected 1 item after restart, got %d, %v", q.Len(), err)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	c, done := tempCache(t)
+	defer done()
+
+	tr := NewTracker(c)
+	key := models.CacheKey("example.com/tracker", models.DEVICE_MOBILE)
+
+	if ok, err := tr.Enqueue(key, models.PriorityWarm); !ok || err != nil {
+		t.Fatalf("Expected URL to be enqueued, got %v, %v", ok, err)
+	}
+	// Duplicate only raises priority
+	if ok, err := tr.Enqueue(key, models.PriorityNew); ok || err != nil {
+		t.Fatalf("Expected duplicate to be suppressed, got %v, %v", ok, err)
+	}
+	v, err := c.Get([]byte(models.PREFIX_ENQUEUE + key))
+	if err != nil || models.ParsePriority(v) != models.PriorityNew {
+		t.Fatalf("Expected priority to be raised, got %v, %v", v, err)
+	}
+
+	// URL stuck on server is enqueued again
+	tr.Mark(key, models.URLSent, "")
+	if ok, _ := tr.Enqueue(key, models.PriorityNew); ok {
+		t.Fatal("Expected sent URL not to be enqueued")
+	}
+	s, _ := tr.Status(key)
+	if err := tr.save(key, s, time.Now().Add(-TRACK_SENT_TIMEOUT)); err != nil {
+		t.Fatalf("Can't save status: %s", err)
+	}
+	if _, err := tr.Reap(); err != nil {
+		t.Fatalf("Can't reap: %s", err)
+	}
+	s, ok := tr.Status(key)
+	if !ok || s.State != models.URLQueued || s.Attempts != 1 || s.Device != models.DEVICE_MOBILE {
+		t.Fatalf("Expected URL to be queued again, got %+v", s)
+	}
+
+	// Cached page is refreshed only once it's old
+	tr.Mark(key, models.URLCached, "")
+	if ok, _ := tr.Refresh(key); ok {
+		t.Fatal("Expected fresh page not to be refreshed")
+	}
+	s, _ = tr.Status(key)
+	if err := tr.save(key, s, time.Now().Add(-TRACK_REFRESH_AGE)); err != nil {
+		t.Fatalf("Can't save status: %s", err)
+	}
+	if ok, _ := tr.Refresh(key); !ok {
+		t.Fatal("Expected old page to be refreshed")
+	}
+	v, err = c.Get([]byte(models.PREFIX_ENQUEUE + key))
+	if err != nil || models.ParsePriority(v) != models.PriorityRefresh {
+		t.Fatalf("Expected refresh priority, got %v, %v", v, err)
+	}
+
+	// Cached page may be enqueued again once it's gone
+	tr.Mark(key, models.URLCached, "")
+	if ok, _ := tr.Enqueue(key, models.PriorityNew); !ok {
+		t.Fatal("Expected cached URL to be enqueued")
+	}
+}
+
+func TestTrackerReapPages(t *testing.T) {
+	c, done := tempCache(t)
+	defer done()
+
+	tr := NewTracker(c)
+	now := time.Now()
+	// Statuses of cached URLs sort before stuck one and fill whole page of scan
+	for i := 0; i < TRACK_REAP_LIMIT; i++ {
+		key := models.CacheKey(fmt.Sprintf("a.example.com/%04d", i), models.DEVICE_DESKTOP)
+		if err := tr.save(key, models.URLStatus{State: models.URLCached}, now); err != nil {
+			t.Fatalf("Can't save status: %s", err)
+		}
+	}
+	key := models.CacheKey("z.example.com/stuck", models.DEVICE_DESKTOP)
+	if err := tr.save(key, models.URLStatus{State: models.URLSent}, now.Add(-TRACK_SENT_TIMEOUT)); err != nil {
+		t.Fatalf("Can't save status: %s", err)
+	}
+
+	if n, err := tr.Reap(); n != 1 || err != nil {
+		t.Fatalf("Expected stuck URL to be reaped, got %d, %v", n, err)
+	}
+	if s, _ := tr.Status(key); s.State != models.URLQueued {
+		t.Fatalf("Expected URL to be queued again, got %+v", s)
+	}
+}
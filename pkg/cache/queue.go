@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	PREFIX_QUEUE       = "Q:"
+	QUEUE_POLL_PERIOD  = 1 * time.Second    // How often empty queue is checked, besides notifications of Push
+	QUEUE_MAX_ATTEMPTS = 5                  // Item returned this many times is moved to dead letters
+	QUEUE_DEAD_TTL     = 7 * 24 * time.Hour // How long dead letters are kept for investigation
+
+	ErrorQueueFull = models.Error("Queue is full")
+)
+
+/*
+Queue is a disk-backed FIFO queue on top of Cacher with at-least-once delivery.
+Popped items are in flight until they are acknowledged,
+in-flight items are delivered again after Nack or restart.
+Item which keeps failing is moved to dead letters, so it doesn't block queue.
+*/
+type Queue struct {
+	c        Cacher
+	ready    string // Prefix of items waiting for delivery
+	flight   string // Prefix of delivered, but not acknowledged items
+	attempts string // Prefix of counters of failed deliveries
+	dead     string // Prefix of items given up after QUEUE_MAX_ATTEMPTS
+	limit    int    // Max amount of items, 0 for unlimited
+
+	mtx    sync.Mutex
+	seq    int64
+	size   int // Amount of items waiting and in flight
+	notify chan struct{}
+}
+
+// Open queue of up to limit items, 0 for unlimited.
+// Items which were in flight before restart are delivered again.
+func NewQueue(c Cacher, name string, limit uint) (*Queue, error) {
+	q := Queue{
+		c:        c,
+		ready:    PREFIX_QUEUE + name + ":R:",
+		flight:   PREFIX_QUEUE + name + ":F:",
+		attempts: PREFIX_QUEUE + name + ":A:",
+		dead:     PREFIX_QUEUE + name + ":D:",
+		limit:    int(limit),
+		notify:   make(chan struct{}, 1),
+	}
+	if err := q.Recover(); err != nil {
+		return nil, err
+	}
+	size, err := q.count(q.ready)
+	if err != nil {
+		return nil, err
+	}
+	q.size = size
+	return &q, nil
+}
+
+// Push item to the end of queue, fails if queue is full
+func (q *Queue) Push(v []byte) error {
+	q.mtx.Lock()
+	if q.limit > 0 && q.size >= q.limit {
+		q.mtx.Unlock()
+		return ErrorQueueFull
+	}
+	// Time based, so order is kept after restart
+	q.seq++
+	if now := time.Now().UnixNano(); now > q.seq {
+		q.seq = now
+	}
+	id := fmt.Sprintf("%020d", q.seq)
+	err := q.c.Set([]byte(q.ready+id), v)
+	if err == nil {
+		q.size++
+	}
+	q.mtx.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "Push: q.c.Set:")
+	}
+	q.wake()
+	return nil
+}
+
+// Amount of items waiting and in flight
+func (q *Queue) Len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.size
+}
+
+// Whether Push would fail
+func (q *Queue) Full() bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.limit > 0 && q.size >= q.limit
+}
+
+// Pop first item, waiting for it if queue is empty.
+// Item has to be acknowledged with Ack or returned with Nack.
+func (q *Queue) Pop() (string, []byte, error) {
+	for {
+		id, v, err := q.pop()
+		if err != nil || id != "" {
+			return id, v, err
+		}
+		select {
+		case <-q.notify:
+		case <-time.After(QUEUE_POLL_PERIOD):
+		}
+	}
+}
+
+// Ack removes delivered item
+func (q *Queue) Ack(id string) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	// Late or duplicate ack of item which isn't in flight anymore
+	if _, err := q.c.Get([]byte(q.flight + id)); err == ErrorNotFound {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "Ack: q.c.Get:")
+	}
+	if err := q.c.Delete([]byte(q.flight + id)); err != nil {
+		return errors.Wrap(err, "Ack: q.c.Delete:")
+	}
+	q.size--
+	if err := q.c.Delete([]byte(q.attempts + id)); err != nil {
+		return errors.Wrap(err, "Ack: q.c.Delete:")
+	}
+	return nil
+}
+
+// Nack returns delivered item to queue, at its former position,
+// or moves it to dead letters once it failed QUEUE_MAX_ATTEMPTS times
+func (q *Queue) Nack(id string) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	v, err := q.c.Get([]byte(q.flight + id))
+	if err != nil {
+		return errors.Wrap(err, "Nack: q.c.Get:")
+	}
+	if err := q.giveBack(id, v); err != nil {
+		return errors.Wrap(err, "Nack:")
+	}
+	return nil
+}
+
+// Recover returns all in-flight items to queue, they're mostly awaiting ack, so it isn't counted as failure
+func (q *Queue) Recover() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for {
+		items, err := q.c.Scan([]byte(q.flight), 100)
+		if err != nil {
+			return errors.Wrap(err, "Recover: q.c.Scan:")
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		for _, i := range items {
+			id := string(i.Key[len(q.flight):])
+			if err := q.move(q.flight+id, q.ready+id, i.Value); err != nil {
+				return errors.Wrap(err, "Recover:")
+			}
+		}
+		q.wake()
+	}
+}
+
+// Mark first item as in flight, empty id means queue is empty
+func (q *Queue) pop() (string, []byte, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	items, err := q.c.Scan([]byte(q.ready), 1)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Pop: q.c.Scan:")
+	}
+	if len(items) == 0 {
+		return "", nil, nil
+	}
+	id := string(items[0].Key[len(q.ready):])
+	if err := q.move(q.ready+id, q.flight+id, items[0].Value); err != nil {
+		return "", nil, errors.Wrap(err, "Pop:")
+	}
+	return id, items[0].Value, nil
+}
+
+// Count failed delivery of in-flight item and return it to queue, or give it up. Caller holds lock.
+func (q *Queue) giveBack(id string, v []byte) error {
+	attempts := 1
+	if b, err := q.c.Get([]byte(q.attempts + id)); err == nil {
+		if n, err := strconv.Atoi(string(b)); err == nil {
+			attempts = n + 1
+		}
+	} else if err != ErrorNotFound {
+		return errors.Wrap(err, "giveBack: q.c.Get:")
+	}
+	if attempts >= QUEUE_MAX_ATTEMPTS {
+		log.Printf("Queue: item %s%s is failed after %d attempts", q.dead, id, attempts)
+		if err := q.c.Setex([]byte(q.dead+id), QUEUE_DEAD_TTL, v); err != nil {
+			return errors.Wrap(err, "giveBack: q.c.Setex:")
+		}
+		if err := q.c.Delete([]byte(q.flight + id)); err != nil {
+			return errors.Wrap(err, "giveBack: q.c.Delete:")
+		}
+		q.size--
+		return q.c.Delete([]byte(q.attempts + id))
+	}
+	if err := q.c.Set([]byte(q.attempts+id), []byte(strconv.Itoa(attempts))); err != nil {
+		return errors.Wrap(err, "giveBack: q.c.Set:")
+	}
+	if err := q.move(q.flight+id, q.ready+id, v); err != nil {
+		return err
+	}
+	q.wake()
+	return nil
+}
+
+// Amount of items with prefix
+func (q *Queue) count(prefix string) (int, error) {
+	n := 0
+	from := []byte(prefix)
+	for {
+		items, err := q.c.ScanFrom([]byte(prefix), from, 100)
+		if err != nil {
+			return 0, errors.Wrap(err, "count: q.c.ScanFrom:")
+		}
+		n += len(items)
+		if len(items) < 100 {
+			return n, nil
+		}
+		from = append(items[len(items)-1].Key, 0)
+	}
+}
+
+// Move item between states. Item is written first,
+// so crash in between leads to duplicate, not to loss.
+func (q *Queue) move(from string, to string, v []byte) error {
+	if err := q.c.Set([]byte(to), v); err != nil {
+		return errors.Wrap(err, "move: q.c.Set:")
+	}
+	if err := q.c.Delete([]byte(from)); err != nil {
+		return errors.Wrap(err, "move: q.c.Delete:")
+	}
+	return nil
+}
+
+// Notify waiting Pop
+func (q *Queue) wake() {
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
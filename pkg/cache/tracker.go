@@ -0,0 +1,198 @@
+package cache
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	TRACK_QUEUED_TTL        = 24 * time.Hour   // URL which isn't sent during this time is forgotten
+	TRACK_SENT_TIMEOUT      = 15 * time.Minute // URL accepted by server, but not taken by peer, is enqueued again
+	TRACK_RENDERING_TIMEOUT = 15 * time.Minute // URL taken by peer, but not cached, is enqueued again
+	TRACK_FAILED_BACKOFF    = 1 * time.Hour    // Failed URL isn't enqueued again earlier
+	TRACK_STATUS_TTL        = 24 * time.Hour   // Status of cached or failed URL is kept for this time
+	TRACK_REFRESH_AGE       = 12 * time.Hour   // Cached page older than this is rendered again in background
+	TRACK_MAX_ATTEMPTS      = 5                // Stuck URL is enqueued again this many times, then it's failed
+	TRACK_REAP_LIMIT        = 1000             // Amount of statuses read from cache at once
+	TRACK_REAP_PERIOD       = 1 * time.Minute  // How often stuck URLs are looked for
+)
+
+/*
+Tracker keeps state of enqueued URLs of this app by cache key:
+queued -> sent -> rendering -> cached or failed.
+URL is enqueued once until it's cached, failed or stuck,
+so repeated requests of bot don't make network render page again.
+*/
+type Tracker struct {
+	c   Cacher
+	mtx sync.Mutex
+}
+
+func NewTracker(c Cacher) *Tracker {
+	return &Tracker{c: c}
+}
+
+// Enqueue URL by cache key, false if it's already in progress
+func (t *Tracker) Enqueue(key string, priority models.Priority) (bool, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	now := time.Now()
+	s, ok := t.get(key)
+	if ok && active(s, now) {
+		// More urgent request takes over queued URL
+		if s.State == models.URLQueued && priority < s.Priority {
+			s.Priority = priority
+			return false, t.queue(key, s, now)
+		}
+		return false, nil
+	}
+	return true, t.queue(key, newStatus(key, priority), now)
+}
+
+// Refresh enqueues cached page again once it's older than TRACK_REFRESH_AGE, false if it's fresh or in progress.
+// Page without status was cached before status expired, so it's old too.
+func (t *Tracker) Refresh(key string) (bool, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	now := time.Now()
+	s, ok := t.get(key)
+	if ok && (s.State != models.URLCached || now.Sub(time.Unix(s.Updated, 0)) < TRACK_REFRESH_AGE) {
+		return false, nil
+	}
+	return true, t.queue(key, newStatus(key, models.PriorityRefresh), now)
+}
+
+// Mark change of state of URL
+func (t *Tracker) Mark(key string, state models.URLState, reason string) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	s, ok := t.get(key)
+	if !ok {
+		url, device := models.ParseCacheKey(key)
+		s = models.URLStatus{URL: url, Device: device}
+	}
+	s.State = state
+	s.Reason = reason
+	return t.save(key, s, time.Now())
+}
+
+// Status of URL by cache key
+func (t *Tracker) Status(key string) (models.URLStatus, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.get(key)
+}
+
+// Reap enqueues again URLs stuck on server or peer, returns amount of them.
+// Statuses are paged through, so stuck URLs aren't hidden behind cached ones,
+// and lock is held per URL only, so bots enqueue meanwhile.
+func (t *Tracker) Reap() (int, error) {
+	prefix := []byte(models.PREFIX_ENQUEUED)
+	from := prefix
+	reaped := 0
+	for {
+		items, err := t.c.ScanFrom(prefix, from, TRACK_REAP_LIMIT)
+		if err != nil {
+			return reaped, errors.Wrap(err, "Reap: t.c.ScanFrom:")
+		}
+		for _, i := range items {
+			ok, err := t.reap(string(i.Key[len(prefix):]), time.Now())
+			if err != nil {
+				return reaped, errors.Wrap(err, "Reap:")
+			}
+			if ok {
+				reaped++
+			}
+		}
+		if len(items) < TRACK_REAP_LIMIT {
+			return reaped, nil
+		}
+		// Next page starts right after last key
+		from = append(items[len(items)-1].Key, 0)
+	}
+}
+
+// Enqueue again URL if it's stuck, status is read again under lock, as it may be changed since scan
+func (t *Tracker) reap(key string, now time.Time) (bool, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	s, ok := t.get(key)
+	if !ok || s.State != models.URLSent && s.State != models.URLRendering || active(s, now) {
+		return false, nil
+	}
+	s.Attempts++
+	if s.Attempts >= TRACK_MAX_ATTEMPTS {
+		s.State = models.URLFailed
+		s.Reason = "stuck"
+		return true, t.save(key, s, now)
+	}
+	return true, t.queue(key, s, now)
+}
+
+// Check whether URL shouldn't be enqueued again
+func active(s models.URLStatus, now time.Time) bool {
+	age := now.Sub(time.Unix(s.Updated, 0))
+	switch s.State {
+	case models.URLQueued:
+		return age < TRACK_QUEUED_TTL
+	case models.URLSent:
+		return age < TRACK_SENT_TIMEOUT
+	case models.URLRendering:
+		return age < TRACK_RENDERING_TIMEOUT
+	case models.URLFailed:
+		return age < TRACK_FAILED_BACKOFF
+	}
+	// Cached page was removed, so it's rendered again
+	return false
+}
+
+// Status of URL which isn't enqueued yet
+func newStatus(key string, priority models.Priority) models.URLStatus {
+	url, device := models.ParseCacheKey(key)
+	return models.URLStatus{
+		URL:      url,
+		Device:   device,
+		Priority: priority,
+	}
+}
+
+// Caller holds lock
+func (t *Tracker) get(key string) (models.URLStatus, bool) {
+	var s models.URLStatus
+	b, err := t.c.Get([]byte(models.PREFIX_ENQUEUED + key))
+	if err != nil || len(b) == 0 {
+		return s, false
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return s, false
+	}
+	return s, true
+}
+
+// Put URL to queue of URLs to send, priority is value. Caller holds lock.
+func (t *Tracker) queue(key string, s models.URLStatus, now time.Time) error {
+	if err := t.c.Setex([]byte(models.PREFIX_ENQUEUE+key), TRACK_QUEUED_TTL, s.Priority.Bytes()); err != nil {
+		return errors.Wrap(err, "queue: t.c.Setex:")
+	}
+	s.State = models.URLQueued
+	s.Reason = ""
+	return t.save(key, s, now)
+}
+
+// Caller holds lock
+func (t *Tracker) save(key string, s models.URLStatus, now time.Time) error {
+	s.Updated = now.Unix()
+	b, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "save: json.Marshal:")
+	}
+	if err := t.c.Setex([]byte(models.PREFIX_ENQUEUED+key), TRACK_STATUS_TTL, b); err != nil {
+		return errors.Wrap(err, "save: t.c.Setex:")
+	}
+	return nil
+}
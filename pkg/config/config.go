@@ -1,8 +1,14 @@
 package config
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/c12o16h1/shender/pkg/models"
 )
@@ -13,8 +19,31 @@ const (
 	DEFAULT_INCOMING_QUEUE_LIMIT uint   = 20
 	DEFAULT_OUTGOING_QUEUE_LIMIT uint   = 100
 	DEFAULT_WS_HOST                     = "localhost:8080"
+	DEFAULT_DEBUG_ADDR                  = "127.0.0.1:6060" // Counters and balance aren't public
 
 	DEFAULT_CACHE_TYPE string = "badgerdb"
+
+	DEFAULT_RENDER_BIN     string = "render" // Looked up next to broker binary
+	DEFAULT_RENDER_NETWORK string = "tcp"
+	DEFAULT_WINDOW_WIDTH   int    = 1920
+	DEFAULT_WINDOW_HEIGHT  int    = 1080
+	DEFAULT_RENDER_TIMEOUT        = 20 * time.Second
+	DEFAULT_RENDER_MODE    string = RENDER_MODE_RPC
+	DEFAULT_CHROME_PORT    int    = 9222
+
+	// How pages are rendered
+	RENDER_MODE_RPC    = "rpc"    // Render worker process per page, managed by supervisor
+	RENDER_MODE_CHROME = "chrome" // Chrome launched by broker itself
+	RENDER_MODE_REMOTE = "remote" // Chrome running elsewhere, f.e. in other container, via DevTools endpoint
+
+	DEFAULT_APP_ID          string = "qwerty"
+	DEFAULT_BLOCK_RESOURCES string = "image,media,font"
+	// Analytics, ads and trackers, their hits from renderer only pollute statistics
+	DEFAULT_BLOCK_URLS string = "*google-analytics.com*,*googletagmanager.com*,*doubleclick.net*," +
+		"*googlesyndication.com*,*connect.facebook.net*,*mc.yandex.ru*,*hotjar.com*"
+	DEFAULT_POSTPROCESS   string = "strip_scripts,remove_event_handlers,prerendered_at"
+	DEFAULT_MAX_PAGE_SIZE int    = 5 << 20 // 5MB
+	DEFAULT_KEY_FILE      string = "./shender.key"
 )
 
 // As this would be global config for "microservices" in one app,
@@ -25,39 +54,56 @@ const (
 // So, this is "good" global var
 type Config struct {
 	models.Configurator
-	Main  *MainConfig  `json:"main"`
-	Cache *CacheConfig `json:"cache"`
+	Main   *MainConfig   `json:"main"`
+	Cache  *CacheConfig  `json:"cache"`
+	Render *RenderConfig `json:"render"`
+	App    *AppConfig    `json:"app"`
 }
 
 func (c *Config) Configure() {
 	c.Main.Configure()
 	c.Cache.Configure()
+	c.Render.Configure()
+	c.App.Configure()
 }
 
 type MainConfig struct {
 	models.Configurator
-	Port               uint16 `json:"port"`
-	Dir                string `json:"dir"`
-	IncomingQueueLimit uint   `json:"incoming_queue_limit"`
-	OutgoingQueueLimit uint   `json:"outgoing_queue_limit"`
-	WSHost             string `json:"ws_host"`
+	Port               uint16   `json:"port"`
+	DebugAddr          string   `json:"debug_addr"` // Address of debug listener, empty to disable it
+	Dir                string   `json:"dir"`
+	Sitemap            string   `json:"sitemap"` // Sitemap file which pages are rendered in background, empty to disable
+	IncomingQueueLimit uint     `json:"incoming_queue_limit"`
+	OutgoingQueueLimit uint     `json:"outgoing_queue_limit"`
+	WSHost             string   `json:"ws_host"`
+	WSTLS              bool     `json:"ws_tls"`       // Connect to server with wss://
+	WSCAFile           string   `json:"ws_ca_file"`   // PEM with CA of server, system roots if empty
+	WSEncodings        []string `json:"ws_encodings"` // Encodings offered to server, in order of preference
 }
 
 func (c *MainConfig) Configure() {
 	c.Port = DEFAULT_PORT
+	c.DebugAddr = DEFAULT_DEBUG_ADDR
 	c.Dir = DEFAULT_DIR
 	c.IncomingQueueLimit = DEFAULT_INCOMING_QUEUE_LIMIT
 	c.OutgoingQueueLimit = DEFAULT_OUTGOING_QUEUE_LIMIT
 	c.WSHost = DEFAULT_WS_HOST
+	c.WSEncodings = models.Encodings
 
 	if port := os.Getenv("PORT"); port != "" {
 		if p, err := strconv.Atoi(port); err == nil && p > 0 {
 			c.Port = uint16(p)
 		}
 	}
+	if addr, ok := os.LookupEnv("DEBUG_ADDR"); ok {
+		c.DebugAddr = addr
+	}
 	if dir := os.Getenv("DIR"); dir != "" {
 		c.Dir = dir
 	}
+	if sm := os.Getenv("SITEMAP_FILE"); sm != "" {
+		c.Sitemap = sm
+	}
 
 	if iql := os.Getenv("DEFAULT_INCOMING_QUEUE_LIMIT"); iql != "" {
 		if l, err := strconv.Atoi(iql); err == nil && l > 0 {
@@ -67,12 +113,22 @@ func (c *MainConfig) Configure() {
 
 	if oql := os.Getenv("DEFAULT_OUTGOING_QUEUE_LIMIT"); oql != "" {
 		if l, err := strconv.Atoi(oql); err == nil && l > 0 {
-			c.IncomingQueueLimit = uint(l)
+			c.OutgoingQueueLimit = uint(l)
 		}
 	}
 
 	if h := os.Getenv("WS_HOST"); h != "" {
-		c.Dir = h
+		c.WSHost = h
+	}
+	if t, err := strconv.ParseBool(os.Getenv("WS_TLS")); err == nil {
+		c.WSTLS = t
+	}
+	if ca := os.Getenv("WS_CA_FILE"); ca != "" {
+		c.WSCAFile = ca
+	}
+	// F.e. "json" to turn compact encoding off
+	if enc := os.Getenv("WS_ENCODINGS"); enc != "" {
+		c.WSEncodings = splitList(enc)
 	}
 }
 
@@ -92,10 +148,232 @@ func (c *CacheConfig) Configure() {
 	}
 }
 
+// Render workers and headless Chrome options
+type RenderConfig struct {
+	models.Configurator
+	Mode         string        `json:"mode"`          // How pages are rendered, one of RENDER_MODE_*
+	RemoteURL    string        `json:"remote_url"`    // DevTools endpoint of remote Chrome, f.e. http://chrome:9222/json
+	ChromePort   int           `json:"chrome_port"`   // First debugging port of Chrome launched by broker
+	Bin          string        `json:"bin"`           // Path to render worker binary
+	Network      string        `json:"network"`       // Network for RPC with workers, "tcp" or "unix"
+	ChromeBin    string        `json:"chrome_bin"`    // Path to Chrome, looked up in PATH if empty
+	Headless     bool          `json:"headless"`      // Run Chrome in headless mode
+	NoSandbox    bool          `json:"no_sandbox"`    // Required to run Chrome as root, f.e. in containers
+	DisableGPU   bool          `json:"disable_gpu"`   // Disable GPU process
+	Proxy        string        `json:"proxy"`         // Outbound proxy server
+	UserDataDir  string        `json:"user_data_dir"` // Base dir for Chrome profiles, each worker uses own subdir
+	WindowWidth  int           `json:"window_width"`  // Initial window size
+	WindowHeight int           `json:"window_height"` // Initial window size
+	ChromeFlags  []string      `json:"chrome_flags"`  // Extra Chrome flags, f.e. "lang=en-US"
+	Timeout      time.Duration `json:"timeout"`       // Max time to render one page
+}
+
+func (c *RenderConfig) Configure() {
+	c.Mode = DEFAULT_RENDER_MODE
+	c.ChromePort = DEFAULT_CHROME_PORT
+	c.Bin = defaultRenderBin()
+	c.Network = DEFAULT_RENDER_NETWORK
+	c.Headless = true
+	c.DisableGPU = true
+	c.WindowWidth = DEFAULT_WINDOW_WIDTH
+	c.WindowHeight = DEFAULT_WINDOW_HEIGHT
+	c.Timeout = DEFAULT_RENDER_TIMEOUT
+
+	switch m := os.Getenv("RENDER_MODE"); m {
+	case RENDER_MODE_RPC, RENDER_MODE_CHROME, RENDER_MODE_REMOTE:
+		c.Mode = m
+	}
+	if u := os.Getenv("RENDER_REMOTE_URL"); u != "" {
+		c.RemoteURL = u
+	}
+	if port := os.Getenv("CHROME_PORT"); port != "" {
+		if p, err := strconv.Atoi(port); err == nil && p > 0 {
+			c.ChromePort = p
+		}
+	}
+	if bin := os.Getenv("RENDER_BIN"); bin != "" {
+		c.Bin = bin
+	}
+	if n := os.Getenv("RENDER_NETWORK"); n == "tcp" || n == "unix" {
+		c.Network = n
+	}
+	if bin := os.Getenv("CHROME_BIN"); bin != "" {
+		c.ChromeBin = bin
+	}
+	if h, err := strconv.ParseBool(os.Getenv("CHROME_HEADLESS")); err == nil {
+		c.Headless = h
+	}
+	if ns, err := strconv.ParseBool(os.Getenv("CHROME_NO_SANDBOX")); err == nil {
+		c.NoSandbox = ns
+	}
+	if dg, err := strconv.ParseBool(os.Getenv("CHROME_DISABLE_GPU")); err == nil {
+		c.DisableGPU = dg
+	}
+	if proxy := os.Getenv("CHROME_PROXY"); proxy != "" {
+		c.Proxy = proxy
+	}
+	if dir := os.Getenv("CHROME_USER_DATA_DIR"); dir != "" {
+		c.UserDataDir = dir
+	}
+	// Window size as "1920,1080"
+	if ws := strings.Split(os.Getenv("CHROME_WINDOW_SIZE"), ","); len(ws) == 2 {
+		w, errW := strconv.Atoi(ws[0])
+		h, errH := strconv.Atoi(ws[1])
+		if errW == nil && errH == nil && w > 0 && h > 0 {
+			c.WindowWidth = w
+			c.WindowHeight = h
+		}
+	}
+	// Timeout in seconds
+	if t := os.Getenv("RENDER_TIMEOUT"); t != "" {
+		if s, err := strconv.Atoi(t); err == nil && s > 0 {
+			c.Timeout = time.Duration(s) * time.Second
+		}
+	}
+	// Extra flags as "lang=en-US,mute-audio"
+	if flags := os.Getenv("CHROME_FLAGS"); flags != "" {
+		c.ChromeFlags = splitList(flags)
+	}
+}
+
+// This app in the network and how its pages should be rendered by others
+type AppConfig struct {
+	models.Configurator
+	ID           string               `json:"id"`
+	Secret       string               `json:"-"` // Shared with server, to answer auth challenge
+	Token        string               `json:"-"` // Token issued by server, alternative to secret
+	Render       models.RenderOptions `json:"render"`
+	PostProcess  []string             `json:"postprocess"`   // Steps to process received pages before storing
+	MaxPageSize  int                  `json:"max_page_size"` // Max size of stored page in bytes
+	Hosts        []string             `json:"hosts"`         // Hosts of app, received pages must belong to them
+	TrustedHosts []string             `json:"trusted_hosts"` // Hosts allowed to serve scripts and frames in received pages
+	Replicas     int                  `json:"replicas"`      // Amount of peers to render every page, for cross-verification
+	Quorum       int                  `json:"quorum"`        // Amount of peers which have to render same content
+	KeyFile      string               `json:"key_file"`      // Private key to sign rendered pages, created if missing
+	BannedPeers  []string             `json:"banned_peers"`  // Peers which pages are never accepted
+}
+
+func (c *AppConfig) Configure() {
+	c.ID = DEFAULT_APP_ID
+	c.Render.BlockResources = splitList(DEFAULT_BLOCK_RESOURCES)
+	c.Render.BlockURLs = splitList(DEFAULT_BLOCK_URLS)
+	c.PostProcess = splitList(DEFAULT_POSTPROCESS)
+	c.MaxPageSize = DEFAULT_MAX_PAGE_SIZE
+	c.KeyFile = DEFAULT_KEY_FILE
+
+	if id := os.Getenv("APP_ID"); id != "" {
+		c.ID = id
+	}
+	c.Secret = os.Getenv("APP_SECRET")
+	c.Token = os.Getenv("APP_TOKEN")
+	// Empty value is allowed and means nothing to block
+	if br, ok := os.LookupEnv("RENDER_BLOCK_RESOURCES"); ok {
+		c.Render.BlockResources = splitList(br)
+	}
+	if bu, ok := os.LookupEnv("RENDER_BLOCK_URLS"); ok {
+		c.Render.BlockURLs = splitList(bu)
+	}
+	if s := os.Getenv("RENDER_SCREENSHOT"); s == models.SCREENSHOT_VIEWPORT || s == models.SCREENSHOT_FULL {
+		c.Render.Screenshot = s
+	}
+	if pdf, err := strconv.ParseBool(os.Getenv("RENDER_PDF")); err == nil {
+		c.Render.PDF = pdf
+	}
+	// Headers, cookies and localStorage are JSON, as values may contain any separator
+	if h := os.Getenv("RENDER_HEADERS"); h != "" {
+		if err := json.Unmarshal([]byte(h), &c.Render.Headers); err != nil {
+			log.Print("RENDER_HEADERS: ", err)
+		}
+	}
+	if ck := os.Getenv("RENDER_COOKIES"); ck != "" {
+		if err := json.Unmarshal([]byte(ck), &c.Render.Cookies); err != nil {
+			log.Print("RENDER_COOKIES: ", err)
+		}
+	}
+	if ls := os.Getenv("RENDER_LOCAL_STORAGE"); ls != "" {
+		if err := json.Unmarshal([]byte(ls), &c.Render.LocalStorage); err != nil {
+			log.Print("RENDER_LOCAL_STORAGE: ", err)
+		}
+	}
+	c.Render.PreScript = readScript("RENDER_PRE_SCRIPT_FILE")
+	c.Render.PostScript = readScript("RENDER_POST_SCRIPT_FILE")
+
+	// Empty value is allowed and means store pages as is
+	if pp, ok := os.LookupEnv("POSTPROCESS"); ok {
+		c.PostProcess = splitList(pp)
+	}
+	if mps := os.Getenv("MAX_PAGE_SIZE"); mps != "" {
+		if s, err := strconv.Atoi(mps); err == nil && s >= 0 {
+			c.MaxPageSize = s
+		}
+	}
+	if h := os.Getenv("APP_HOSTS"); h != "" {
+		c.Hosts = splitList(h)
+	}
+	if th := os.Getenv("TRUSTED_HOSTS"); th != "" {
+		c.TrustedHosts = splitList(th)
+	}
+	c.Replicas = 1
+	if r := os.Getenv("VERIFY_REPLICAS"); r != "" {
+		if n, err := strconv.Atoi(r); err == nil && n > 0 {
+			c.Replicas = n
+		}
+	}
+	// By default majority of replicas
+	if q := os.Getenv("VERIFY_QUORUM"); q != "" {
+		if n, err := strconv.Atoi(q); err == nil && n > 0 && n <= c.Replicas {
+			c.Quorum = n
+		}
+	}
+	if kf := os.Getenv("KEY_FILE"); kf != "" {
+		c.KeyFile = kf
+	}
+	if bp := os.Getenv("BANNED_PEERS"); bp != "" {
+		c.BannedPeers = splitList(bp)
+	}
+}
+
+// Read script from file, which path is in env variable
+func readScript(env string) string {
+	path := os.Getenv(env)
+	if path == "" {
+		return ""
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Print(env, ": ", err)
+		return ""
+	}
+	return string(b)
+}
+
+// Split comma separated list, skipping empty items
+func splitList(s string) []string {
+	var list []string
+	for _, i := range strings.Split(s, ",") {
+		if i = strings.TrimSpace(i); i != "" {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+// Render binary is expected next to broker binary,
+// so broker doesn't depend on working directory
+func defaultRenderBin() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return filepath.Join(".", "bin", DEFAULT_RENDER_BIN)
+	}
+	return filepath.Join(filepath.Dir(exe), DEFAULT_RENDER_BIN)
+}
+
 func New() *Config {
 	cfg := Config{
-		Main:  &MainConfig{},
-		Cache: &CacheConfig{},
+		Main:   &MainConfig{},
+		Cache:  &CacheConfig{},
+		Render: &RenderConfig{},
+		App:    &AppConfig{},
 	}
 	cfg.Configure()
 	return &cfg
@@ -0,0 +1,311 @@
+package models
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	ENCODING_JSON   = "json"     // Original encoding, page is JSON string inside JSON message
+	ENCODING_BINARY = "binary/1" // Length prefixed fields with raw bytes, compressed if large
+
+	BINARY_MAGIC        byte = 'S'
+	BINARY_VERSION      byte = 1
+	BINARY_FLAG_DEFLATE byte = 1 << 0
+
+	COMPRESS_THRESHOLD = 1024 // Smaller messages aren't worth compression
+
+	ERR_INVALID_FRAME   = Error("Invalid binary frame")
+	ERR_UNKNOWN_VERSION = Error("Unknown binary frame version")
+	ERR_FRAME_TOO_BIG   = Error("Binary frame is too big")
+)
+
+// Codec encodes messages on wire
+type Codec interface {
+	Name() string
+	Marshal(m WSMessage) ([]byte, error)
+	Unmarshal(b []byte, m *WSMessage) error
+	UnmarshalPage(b []byte, p *DataResponseCachedPage) error
+	UnmarshalPages(b []byte) ([]DataResponseCachedPage, error)
+}
+
+// Known codecs by name, in order of preference
+var (
+	Codecs = map[string]Codec{
+		ENCODING_BINARY: BinaryCodec{},
+		ENCODING_JSON:   JSONCodec{},
+	}
+	Encodings = []string{ENCODING_BINARY, ENCODING_JSON}
+)
+
+// JSONCodec is understood by every server and broker
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return ENCODING_JSON
+}
+
+func (JSONCodec) Marshal(m WSMessage) ([]byte, error) {
+	if m.Page != nil {
+		b, err := json.Marshal(m.Page)
+		if err != nil {
+			return nil, err
+		}
+		m.Data = string(b)
+	}
+	if m.Pages != nil {
+		b, err := json.Marshal(m.Pages)
+		if err != nil {
+			return nil, err
+		}
+		m.Data = string(b)
+	}
+	return json.Marshal(m)
+}
+
+func (JSONCodec) Unmarshal(b []byte, m *WSMessage) error {
+	return json.Unmarshal(b, m)
+}
+
+func (JSONCodec) UnmarshalPage(b []byte, p *DataResponseCachedPage) error {
+	return json.Unmarshal(b, p)
+}
+
+func (JSONCodec) UnmarshalPages(b []byte) ([]DataResponseCachedPage, error) {
+	var pages []DataResponseCachedPage
+	err := json.Unmarshal(b, &pages)
+	return pages, err
+}
+
+/*
+BinaryCodec writes fields in fixed order, numbers as varints,
+strings and bytes with length prefix, so HTML is never escaped.
+Frame is "S", version, flags and body, which is deflated if it's large.
+*/
+type BinaryCodec struct{}
+
+func (BinaryCodec) Name() string {
+	return ENCODING_BINARY
+}
+
+func (c BinaryCodec) Marshal(m WSMessage) ([]byte, error) {
+	if m.Page != nil {
+		m.Data = string(c.marshalPage(*m.Page))
+	}
+	// Batch is amount of pages and pages with length prefix
+	if m.Pages != nil {
+		var w writer
+		w.uvarint(uint64(len(m.Pages)))
+		for _, p := range m.Pages {
+			w.bytes(c.marshalPage(p))
+		}
+		m.Data = w.String()
+	}
+	var w writer
+	w.uvarint(uint64(m.Type))
+	w.varint(int64(m.Code))
+	w.string(m.ID)
+	w.string(m.ReplyTo)
+	w.string(m.AppID)
+	w.string(m.Token)
+	w.string(m.Error)
+	w.string(m.Message)
+	w.string(m.Data)
+	return frame(w.Bytes())
+}
+
+func (BinaryCodec) Unmarshal(b []byte, m *WSMessage) error {
+	body, err := unframe(b)
+	if err != nil {
+		return err
+	}
+	r := reader{b: body}
+	*m = WSMessage{
+		Type:    WSType(r.uvarint()),
+		Code:    int(r.varint()),
+		ID:      r.string(),
+		ReplyTo: r.string(),
+		AppID:   r.string(),
+		Token:   r.string(),
+		Error:   r.string(),
+		Message: r.string(),
+		Data:    r.string(),
+	}
+	return r.err
+}
+
+// Page is already inside compressed frame, so it isn't compressed again
+func (BinaryCodec) marshalPage(p DataResponseCachedPage) []byte {
+	var w writer
+	w.string(p.URL)
+	w.string(p.HTML)
+	w.string(p.Device)
+	w.string(p.Peer)
+	w.string(p.Hash)
+	w.varint(p.Timestamp)
+	w.bytes(p.Signature)
+	w.bytes(p.Screenshot)
+	w.bytes(p.PDF)
+	return w.Bytes()
+}
+
+func (BinaryCodec) UnmarshalPage(b []byte, p *DataResponseCachedPage) error {
+	r := reader{b: b}
+	*p = DataResponseCachedPage{
+		URL:        r.string(),
+		HTML:       r.string(),
+		Device:     r.string(),
+		Peer:       r.string(),
+		Hash:       r.string(),
+		Timestamp:  r.varint(),
+		Signature:  r.bytes(),
+		Screenshot: r.bytes(),
+		PDF:        r.bytes(),
+	}
+	return r.err
+}
+
+func (c BinaryCodec) UnmarshalPages(b []byte) ([]DataResponseCachedPage, error) {
+	r := reader{b: b}
+	n := r.uvarint()
+	// Every page takes at least one byte, so broken count doesn't allocate much
+	if n > uint64(len(r.b)) {
+		return nil, ERR_INVALID_FRAME
+	}
+	pages := make([]DataResponseCachedPage, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		var p DataResponseCachedPage
+		if err := c.UnmarshalPage(r.bytes(), &p); err != nil {
+			return nil, err
+		}
+		pages = append(pages, p)
+	}
+	return pages, r.err
+}
+
+// Add header and compress body if it's large
+func frame(body []byte) ([]byte, error) {
+	var b bytes.Buffer
+	b.Write([]byte{BINARY_MAGIC, BINARY_VERSION, 0})
+	if len(body) < COMPRESS_THRESHOLD {
+		b.Write(body)
+		return b.Bytes(), nil
+	}
+	b.Bytes()[2] |= BINARY_FLAG_DEFLATE
+	fw, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Check header and decompress body, it may not be larger than WS_MAX_MESSAGE_SIZE
+func unframe(b []byte) ([]byte, error) {
+	if len(b) < 3 || b[0] != BINARY_MAGIC {
+		return nil, ERR_INVALID_FRAME
+	}
+	if b[1] != BINARY_VERSION {
+		return nil, ERR_UNKNOWN_VERSION
+	}
+	if b[2]&BINARY_FLAG_DEFLATE == 0 {
+		return b[3:], nil
+	}
+	fr := flate.NewReader(bytes.NewReader(b[3:]))
+	defer fr.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(fr, WS_MAX_MESSAGE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > WS_MAX_MESSAGE_SIZE {
+		return nil, ERR_FRAME_TOO_BIG
+	}
+	return body, nil
+}
+
+type writer struct {
+	bytes.Buffer
+}
+
+func (w *writer) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (w *writer) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (w *writer) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+func (w *writer) bytes(b []byte) {
+	w.uvarint(uint64(len(b)))
+	w.Write(b)
+}
+
+// Reader keeps first error, so fields are read without checks
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = ERR_INVALID_FRAME
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = ERR_INVALID_FRAME
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) bytes() []byte {
+	l := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if l > uint64(len(r.b)) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	if l == 0 {
+		return nil
+	}
+	b := make([]byte, l)
+	copy(b, r.b)
+	r.b = r.b[l:]
+	return b
+}
+
+func (r *reader) string() string {
+	return string(r.bytes())
+}
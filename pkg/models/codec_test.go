@@ -0,0 +1,101 @@
+package models
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	page := DataResponseCachedPage{
+		URL:        "example.com/",
+		HTML:       `<html><body data-x="quoted">` + strings.Repeat("text ", 1000) + `</body></html>`,
+		Device:     "mobile",
+		Peer:       "peer",
+		Hash:       "abc",
+		Timestamp:  1557000000,
+		Signature:  []byte{1, 2, 3},
+		Screenshot: []byte{0x89, 'P', 'N', 'G'},
+	}
+	for _, name := range Encodings {
+		c := Codecs[name]
+		msg := WSMessage{
+			ID:      "id-1",
+			Type:    TypeResponseCachedPage,
+			Code:    -1,
+			AppID:   "app",
+			Message: "example.com/",
+			Page:    &page,
+		}
+		b, err := c.Marshal(msg)
+		if err != nil {
+			t.Fatalf("%s: can't marshal: %s", name, err)
+		}
+		var m WSMessage
+		if err := c.Unmarshal(b, &m); err != nil {
+			t.Fatalf("%s: can't unmarshal: %s", name, err)
+		}
+		if m.ID != msg.ID || m.Type != msg.Type || m.Code != msg.Code || m.AppID != msg.AppID || m.Message != msg.Message {
+			t.Fatalf("%s: message differs: %+v", name, m)
+		}
+		var p DataResponseCachedPage
+		if err := c.UnmarshalPage([]byte(m.Data), &p); err != nil {
+			t.Fatalf("%s: can't unmarshal page: %s", name, err)
+		}
+		if !reflect.DeepEqual(p, page) {
+			t.Fatalf("%s: page differs: %+v", name, p)
+		}
+
+		// Batch of pages
+		b, err = c.Marshal(WSMessage{Type: TypeResponseCachedN, Pages: []DataResponseCachedPage{page, {URL: "example.com/2"}}})
+		if err != nil {
+			t.Fatalf("%s: can't marshal batch: %s", name, err)
+		}
+		if err := c.Unmarshal(b, &m); err != nil {
+			t.Fatalf("%s: can't unmarshal batch: %s", name, err)
+		}
+		pages, err := c.UnmarshalPages([]byte(m.Data))
+		if err != nil {
+			t.Fatalf("%s: can't unmarshal pages: %s", name, err)
+		}
+		if len(pages) != 2 || !reflect.DeepEqual(pages[0], page) || pages[1].URL != "example.com/2" {
+			t.Fatalf("%s: batch differs: %+v", name, pages)
+		}
+	}
+}
+
+func TestBinaryCodecCompact(t *testing.T) {
+	page := DataResponseCachedPage{HTML: strings.Repeat(`<a href="/">"quoted"</a>`, 1000)}
+	msg := WSMessage{Type: TypeResponseCachedPage, Page: &page}
+	j, _ := JSONCodec{}.Marshal(msg)
+	b, err := BinaryCodec{}.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= len(j)/10 {
+		t.Fatalf("Binary message isn't compact: %d bytes, JSON %d bytes", len(b), len(j))
+	}
+}
+
+func TestBinaryCodecInvalid(t *testing.T) {
+	c := BinaryCodec{}
+	var m WSMessage
+	for _, b := range [][]byte{nil, []byte(`{"type":1}`), {BINARY_MAGIC, 2, 0}, {BINARY_MAGIC, BINARY_VERSION, 0, 1, 0, 200}} {
+		if err := c.Unmarshal(b, &m); err == nil {
+			t.Fatalf("Expected error for %v", b)
+		}
+	}
+	if err := c.UnmarshalPage(bytes.Repeat([]byte{0xff}, 3), &DataResponseCachedPage{}); err == nil {
+		t.Fatal("Expected error for invalid page")
+	}
+
+	// Small frame mustn't inflate beyond limit
+	bomb, err := frame(make([]byte, WS_MAX_MESSAGE_SIZE+1))
+	if err != nil {
+		t.Fatalf("Can't frame: %s", err)
+	}
+	if err := c.Unmarshal(bomb, &m); err != ERR_FRAME_TOO_BIG {
+		t.Fatalf("Expected too big frame, got %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+package models
+
+/*
+Balance of render credits of app.
+Credit is earned for every valid page rendered for other member,
+and spent for every page rendered for this app by other member.
+*/
+type Balance struct {
+	AppID   string `json:"app_id"`
+	Earned  int64  `json:"earned"`
+	Spent   int64  `json:"spent"`
+	Balance int64  `json:"balance"` // Earned minus spent, may be adjusted by server
+	Updated int64  `json:"updated"` // Unix time of last change
+}
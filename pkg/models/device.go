@@ -0,0 +1,71 @@
+package models
+
+import "strings"
+
+const (
+	DEVICE_DESKTOP = "desktop"
+	DEVICE_MOBILE  = "mobile"
+
+	deviceKeySeparator = "|" // Separates device name from URL in cache keys
+)
+
+// Device profile to emulate while rendering
+type Device struct {
+	Name      string  `json:"name"`       // Name of profile, part of cache key
+	Mobile    bool    `json:"mobile"`     // Emulate mobile device, f.e. meta viewport and touch
+	Width     int64   `json:"width"`      // Viewport width in CSS pixels
+	Height    int64   `json:"height"`     // Viewport height in CSS pixels
+	Scale     float64 `json:"scale"`      // Device pixel ratio
+	UserAgent string  `json:"user_agent"` // User agent of browser, not bot, so SPA renders as for visitor
+}
+
+var (
+	DeviceDesktop = Device{
+		Name:      DEVICE_DESKTOP,
+		Width:     1920,
+		Height:    1080,
+		Scale:     1,
+		UserAgent: "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/74.0.3729.131 Safari/537.36",
+	}
+	DeviceMobile = Device{
+		Name:      DEVICE_MOBILE,
+		Mobile:    true,
+		Width:     412,
+		Height:    732,
+		Scale:     2.625,
+		UserAgent: "Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/74.0.3729.131 Mobile Safari/537.36",
+	}
+
+	// Known device profiles by name
+	Devices = map[string]Device{
+		DEVICE_DESKTOP: DeviceDesktop,
+		DEVICE_MOBILE:  DeviceMobile,
+	}
+)
+
+// Get device profile by name, desktop is default
+func DeviceByName(name string) Device {
+	if d, ok := Devices[name]; ok {
+		return d
+	}
+	return DeviceDesktop
+}
+
+// Cache key of page rendered for device.
+// Desktop pages are stored by plain URL, as they always were.
+func CacheKey(url string, device string) string {
+	if device == "" || device == DEVICE_DESKTOP {
+		return url
+	}
+	return device + deviceKeySeparator + url
+}
+
+// Split cache key to URL and device name
+func ParseCacheKey(key string) (url string, device string) {
+	if i := strings.Index(key, deviceKeySeparator); i > 0 {
+		if _, ok := Devices[key[:i]]; ok {
+			return key[i+1:], key[:i]
+		}
+	}
+	return key, DEVICE_DESKTOP
+}
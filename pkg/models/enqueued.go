@@ -0,0 +1,23 @@
+package models
+
+// State of URL of this app enqueued to be rendered by network
+type URLState string
+
+const (
+	URLQueued    URLState = "queued"    // Waiting to be sent to server
+	URLSent      URLState = "sent"      // Accepted by server
+	URLRendering URLState = "rendering" // Taken by peer
+	URLCached    URLState = "cached"    // Rendered page is stored
+	URLFailed    URLState = "failed"    // Page can't be rendered or was rejected
+)
+
+// Status of enqueued URL, it's stored by cache key and reported by server
+type URLStatus struct {
+	URL      string   `json:"url"`
+	Device   string   `json:"device"`
+	State    URLState `json:"state"`
+	Priority Priority `json:"priority"`
+	Attempts int      `json:"attempts"` // Times URL was enqueued again, as it got stuck
+	Reason   string   `json:"reason,omitempty"`
+	Updated  int64    `json:"updated"` // Unix time of last change
+}
@@ -0,0 +1,114 @@
+package models
+
+const (
+	PROTOCOL_VERSION     = 2 // Version of protocol spoken by this broker
+	PROTOCOL_LEGACY      = 1 // Servers which don't answer hello
+	PROTOCOL_MIN_VERSION = 1 // Oldest version this broker can speak
+
+	// Capabilities
+	CAP_ACKS       = "acks"       // Messages with ID are acknowledged
+	CAP_SIGNATURES = "signatures" // Pages are signed, keys are exchanged via server
+	CAP_DEVICES    = "devices"    // Pages are rendered for device profiles
+	CAP_SCREENSHOT = "screenshot" // Screenshots of pages are rendered and delivered
+	CAP_PDF        = "pdf"        // PDFs of pages are rendered and delivered
+	CAP_BATCH      = "batch"      // URLs and cached pages are sent in batches
+	CAP_NOTIFY     = "notify"     // Server notifies when URLs or cached pages are available, so polling is rare
+	CAP_PUSH       = "push"       // Server pushes cached pages as soon as they are rendered
+	CAP_CREDITS    = "credits"    // Server accounts render credits and reports balance
+	CAP_URL_STATE  = "url_state"  // Server reports when enqueued URL is taken by peer or failed
+
+	ERR_PROTOCOL_VERSION = Error("Protocol version of server isn't supported")
+	ERR_UNSUPPORTED_TYPE = Error("Message type isn't supported by server")
+)
+
+// Message types of first protocol, they are supported by every server
+var legacyTypes = []WSType{
+	TypeRequestSendURL,
+	TypeRequestGetUrls,
+	TypeResponseGetUrls,
+	TypeRequestCachedPage,
+	TypeResponseCachedPage,
+	TypeError,
+	TypeOk,
+}
+
+// Hello is exchanged on connect, so both sides know what other one supports
+type Hello struct {
+	Protocol     int      `json:"protocol"`
+	Version      string   `json:"version"` // Version of software, for logs
+	Types        []WSType `json:"types"`
+	Encodings    []string `json:"encodings"`
+	Devices      []string `json:"devices"` // Device profiles pages may be rendered for
+	Capabilities []string `json:"capabilities"`
+}
+
+// Protocol negotiated with server
+type Protocol struct {
+	Version int
+	Server  Hello
+
+	types map[WSType]bool
+	caps  map[string]bool
+}
+
+// Protocol of servers which don't know about hello
+func LegacyProtocol() Protocol {
+	return newProtocol(PROTOCOL_LEGACY, Hello{Protocol: PROTOCOL_LEGACY, Types: legacyTypes})
+}
+
+// Negotiate protocol with server by its hello
+func Negotiate(local Hello, server Hello) (Protocol, error) {
+	v := local.Protocol
+	if server.Protocol < v {
+		v = server.Protocol
+	}
+	if v < PROTOCOL_MIN_VERSION {
+		return Protocol{}, ERR_PROTOCOL_VERSION
+	}
+	p := newProtocol(v, server)
+	// Capability is used only if both sides have it
+	for c := range p.caps {
+		if !contains(local.Capabilities, c) {
+			delete(p.caps, c)
+		}
+	}
+	return p, nil
+}
+
+func newProtocol(v int, server Hello) Protocol {
+	p := Protocol{
+		Version: v,
+		Server:  server,
+		types:   make(map[WSType]bool),
+		caps:    make(map[string]bool),
+	}
+	for _, t := range server.Types {
+		p.types[t] = true
+	}
+	// Answers are understood by everybody
+	p.types[TypeOk] = true
+	p.types[TypeError] = true
+	for _, c := range server.Capabilities {
+		p.caps[c] = true
+	}
+	return p
+}
+
+// Check whether server understands message type
+func (p Protocol) Supports(t WSType) bool {
+	return p.types[t]
+}
+
+// Check whether capability is supported by both sides
+func (p Protocol) Can(c string) bool {
+	return p.caps[c]
+}
+
+func contains(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+	return false
+}
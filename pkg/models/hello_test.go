@@ -0,0 +1,38 @@
+package models
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	local := Hello{
+		Protocol:     PROTOCOL_VERSION,
+		Types:        []WSType{TypeHello, TypeRegisterKey},
+		Capabilities: []string{CAP_ACKS, CAP_SIGNATURES},
+	}
+	server := Hello{
+		Protocol:     PROTOCOL_VERSION + 1,
+		Types:        []WSType{TypeRequestGetUrls},
+		Capabilities: []string{CAP_ACKS, CAP_PDF},
+	}
+	p, err := Negotiate(local, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Version != PROTOCOL_VERSION {
+		t.Fatalf("Expected version %d, got %d", PROTOCOL_VERSION, p.Version)
+	}
+	if !p.Can(CAP_ACKS) || p.Can(CAP_PDF) || p.Can(CAP_SIGNATURES) {
+		t.Fatal("Only capabilities of both sides have to be used")
+	}
+	if !p.Supports(TypeRequestGetUrls) || p.Supports(TypeRegisterKey) || !p.Supports(TypeOk) {
+		t.Fatal("Only types known to server have to be sent")
+	}
+
+	if _, err := Negotiate(local, Hello{Protocol: 0}); err != ERR_PROTOCOL_VERSION {
+		t.Fatalf("Expected %s, got %v", ERR_PROTOCOL_VERSION, err)
+	}
+
+	legacy := LegacyProtocol()
+	if legacy.Can(CAP_ACKS) || !legacy.Supports(TypeResponseCachedPage) || legacy.Supports(TypeHello) {
+		t.Fatal("Legacy protocol has no capabilities and only original types")
+	}
+}
@@ -1,13 +1,17 @@
 package models
 
+import "context"
+
 
 // TODO use JSON from server, not ENV
 type Configurator interface {
 	Configure()
 }
 
+// Renderer renders page in browser.
+// Implementations return ERR_RENDER_TIMEOUT if page isn't rendered within timeout of request.
 type Renderer interface {
-	Render(string) (string, error)
+	Render(ctx context.Context, req RenderRequest) (RenderResult, error)
 }
 
 type Closer interface {
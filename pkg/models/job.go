@@ -1,18 +1,55 @@
 package models
 
+import "time"
+
 const (
 	JobOk     uint8 = 0
 	JobFailed uint8 = 1
 )
 
+// Scheduling class of job, jobs with lower value are rendered first
+type Priority uint8
+
+const (
+	PriorityNew     Priority = 0 // Page requested by bot, but not cached yet
+	PriorityRefresh Priority = 1 // Cached page is rendered again
+	PriorityWarm    Priority = 2 // Page from sitemap, cache is warmed in background
+)
+
 type Job struct {
-	Token string `json:"token"`
-	Url   string `json:"url"`
-	AppID string `json:"app_id"`
+	Token     string        `json:"token"`
+	Url       string        `json:"url"`
+	AppID     string        `json:"app_id"`
+	Device    Device        `json:"device"`
+	Options   RenderOptions `json:"options"`
+	Priority  Priority      `json:"priority"`
+	NotBefore int64         `json:"not_before,omitempty"` // Unix time job can't be started before
+	Deadline  int64         `json:"deadline,omitempty"`   // Unix time result isn't needed after, 0 for none
+	Attempts  int           `json:"attempts,omitempty"`   // Failed attempts to render, job is retried locally
+}
+
+// Check whether result of job isn't needed anymore
+func (j Job) Expired(now time.Time) bool {
+	return j.Deadline > 0 && now.Unix() >= j.Deadline
+}
+
+// Priority stored as value of enqueued URL, empty value is new page
+func ParsePriority(b []byte) Priority {
+	if len(b) == 0 {
+		return PriorityNew
+	}
+	return Priority(b[0])
+}
+
+func (p Priority) Bytes() []byte {
+	return []byte{byte(p)}
 }
 
 type JobResult struct {
 	Job
-	HTML   string
-	Status uint8
+	HTML       string
+	Screenshot []byte
+	PDF        []byte
+	Status     uint8
+	Reason     string // Why job failed
 }
@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+// Resource types which may be blocked while rendering
+const (
+	RESOURCE_IMAGE      = "image"
+	RESOURCE_MEDIA      = "media"
+	RESOURCE_FONT       = "font"
+	RESOURCE_STYLESHEET = "stylesheet"
+)
+
+// Screenshot modes
+const (
+	SCREENSHOT_VIEWPORT = "viewport" // Only visible part of page
+	SCREENSHOT_FULL     = "full"     // Whole page
+)
+
+// Per app options how pages should be rendered.
+// Owner of app configures them and they travel with every job.
+type RenderOptions struct {
+	BlockResources []string `json:"block_resources"` // Resource types to block, f.e. image, media, font
+	BlockURLs      []string `json:"block_urls"`      // URL patterns to block, "*" is a wildcard
+	Screenshot     string   `json:"screenshot"`      // Capture PNG screenshot, SCREENSHOT_VIEWPORT or SCREENSHOT_FULL
+	PDF            bool     `json:"pdf"`             // Capture PDF of page
+
+	// Make page render its public variant
+	Headers      map[string]string `json:"headers"`       // Extra request headers, f.e. Accept-Language
+	Cookies      []Cookie          `json:"cookies"`       // Cookies set before navigation
+	LocalStorage map[string]string `json:"local_storage"` // localStorage entries set before page scripts run
+	PreScript    string            `json:"pre_script"`    // Script evaluated in every document before its own scripts
+	PostScript   string            `json:"post_script"`   // Script evaluated after page is loaded, before capture
+}
+
+// Cookie to set in browser before navigation
+type Cookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain"` // Host of page, if empty
+	Path   string `json:"path"`
+}
+
+const (
+	ERR_RENDER_TIMEOUT = Error("Render timeout")
+	ERR_EMPTY_RESULT   = Error("Rendered page is empty")
+)
+
+// Request to render worker
+type RenderRequest struct {
+	URL     string        // Full URL of page
+	Device  Device        // Device to emulate
+	Options RenderOptions // Options of app owning the page
+	Timeout time.Duration // Max time for the whole render
+}
+
+// Result of render worker
+type RenderResult struct {
+	HTML       string // Page source
+	Screenshot []byte // PNG, if requested
+	PDF        []byte // PDF, if requested
+}
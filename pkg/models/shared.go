@@ -3,6 +3,27 @@ package models
 const (
 	PREFIX_ENQUEUE  = "ENQ:"
 	PREFIX_ENQUEUED = "ENQD:"
+	// URLs sent to server, but not acknowledged yet
+	PREFIX_ENQUEUE_FLIGHT = "ENQF:"
+
+	// Side outputs of render stored next to page
+	PREFIX_SCREENSHOT = "SHOT:"
+	PREFIX_PDF        = "PDF:"
+
+	// Suspicious pages received from network
+	PREFIX_QUARANTINE = "QRNT:"
+	// Who rendered cached page
+	PREFIX_PROVENANCE = "PROV:"
+	// Peers banned for sending forged pages
+	PREFIX_BANNED = "BAN:"
+	// Render credits of this app, counted locally and reported by server
+	PREFIX_CREDITS = "CRED:"
+	CREDITS_LOCAL  = PREFIX_CREDITS + "local"
+	CREDITS_SERVER = PREFIX_CREDITS + "server"
+	CREDITS_SPENT  = PREFIX_CREDITS + "spent:" // Pages credit was spent for, by signature hash
+
+	// Render worker reports "LISTEN <network> <address>" to stdout once ready to accept RPC
+	RENDER_LISTEN = "LISTEN"
 )
 
 var OK = "OK"
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Hash of raw page HTML, as it's signed by peer
+func HTMLHash(html string) string {
+	return ContentHash([]byte(html))
+}
+
+// Hash of content, empty for no content
+func ContentHash(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Bytes of page signed by peer: URL, device, content hashes and timestamp.
+// Screenshot and PDF are signed too, so they can't be replaced on the way.
+func SignaturePayload(p DataResponseCachedPage) []byte {
+	return []byte(strings.Join([]string{
+		p.Peer,
+		p.URL,
+		p.Device,
+		p.Hash,
+		ContentHash(p.Screenshot),
+		ContentHash(p.PDF),
+		strconv.FormatInt(p.Timestamp, 10),
+	}, "\n"))
+}
@@ -1,33 +1,61 @@
 package models
 
 type WSMessage struct {
-	Code    int    `json:"code"`    // Code, for errors
-	Type    WSType `json:"type"`    // Type of message
-	AppID   string `json:"app_id"`  // AppID of "owner" app
-	Token   string `json:"token"`   // Unique token
-	Error   string `json:"error"`   // Error message
-	Message string `json:"message"` // Success message
-	Data    string `json:"data"`    // Any specific payload
+	ID      string `json:"id,omitempty"`       // Unique ID, for messages which are acknowledged
+	ReplyTo string `json:"reply_to,omitempty"` // ID of message this one answers
+	Code    int    `json:"code"`               // Code, for errors
+	Type    WSType `json:"type"`               // Type of message
+	AppID   string `json:"app_id"`             // AppID of "owner" app
+	Token   string `json:"token"`              // Unique token
+	Error   string `json:"error"`              // Error message
+	Message string `json:"message"`            // Success message
+	Data    string `json:"data"`               // Any specific payload
+
+	Page  *DataResponseCachedPage  `json:"-"` // Page to send, it's encoded into Data by codec of connection
+	Pages []DataResponseCachedPage `json:"-"` // Batch of pages to send, encoded into Data like Page
 }
 
 type WSType uint
 
 const (
+	TypeAuthChallenge      WSType = 1   // Message from server with nonce to prove app secret
+	TypeAuthResponse       WSType = 2   // Message to server with HMAC of nonce
+	TypeHello              WSType = 3   // Message with protocol version and capabilities, sent by both sides on connect
 	TypeRequestSendURL     WSType = 11  // Message to send URL to server to enqueue for crawling by 3-rd party crawler
+	TypeRequestSendURLs    WSType = 12  // Message to send batch of URLs to server, data is JSON array of URLRich
 	TypeRequestGetUrls     WSType = 20  // Message to server to get URLs for crawl
 	TypeResponseGetUrls    WSType = 21  // Message from server with url to crawl
+	TypeRequestGetUrlsN    WSType = 22  // Message to server to get up to N URLs for crawl, N is in message
+	TypeResponseGetUrlsN   WSType = 23  // Message from server with batch of URLs, data is JSON array of JobURL
 	TypeRequestCachedPage  WSType = 30  // Message to server with result of crawling some URL
 	TypeResponseCachedPage WSType = 40  // Message from server with content of cached page
+	TypeResponseCachedN    WSType = 41  // Message from server with batch of cached pages
+	TypeResponseJobFailed  WSType = 42  // Message to server that URL can't be rendered, URL is in message, reason in error
+	TypeNotify             WSType = 60  // Message from server that URLs or cached pages are available, kind is in message
+	TypeURLState           WSType = 61  // Message from server that state of enqueued URL changed, data is JSON of URLStatus
+	TypeRequestBalance     WSType = 70  // Message to server to get render credits of this app
+	TypeResponseBalance    WSType = 71  // Message from server with render credits of this app, data is JSON of Balance
+	TypeRegisterKey        WSType = 50  // Message to server with public key of this broker
+	TypeRequestPeerKey     WSType = 51  // Message to server to get public key of other member
+	TypeResponsePeerKey    WSType = 52  // Message from server with public key of other member
+	TypeReportPeer         WSType = 53  // Message to server about member which sent invalid result
 	TypeError              WSType = 100 // Error
 	TypeOk                 WSType = 101 // Ok
 
 	// Error codes for requests
+	CodeAuthFailed         = 401
 	CodeRequestSendURL     = 411
+	CodeLowBalance         = 412 // URLs aren't accepted until app renders for others, wait time is in message
 	CodeRequestGetUrls     = 420
 	CodeResponseGetUrls    = 421
 	CodeSleeperGetUrls     = 422
 	CodeRequestCachedPage  = 430
 	CodeResponseCachedPage = 440
+	CodeRequestPeerKey     = 451
+
+	// Kinds of notifications
+	NotifyURLs  = "urls"
+	NotifyCache = "cache"
 )
 
 // Custom data types
@@ -39,8 +67,15 @@ in Redis List type as record for cache:app key
 And will be returned as is to move to local cache
   */
 type DataResponseCachedPage struct {
-	URL  string `json:"url"`
-	HTML string `json:"html"`
+	URL        string `json:"url"`
+	HTML       string `json:"html"`
+	Device     string `json:"device"`               // Name of device page was rendered for
+	Peer       string `json:"peer"`                 // AppID of member which rendered page
+	Hash       string `json:"hash"`                 // Hash of HTML, signed by peer
+	Timestamp  int64  `json:"timestamp"`            // Unix time of signing
+	Signature  []byte `json:"signature"`            // Signature of peer, see SignaturePayload
+	Screenshot []byte `json:"screenshot,omitempty"` // PNG screenshot, if owner asked for it
+	PDF        []byte `json:"pdf,omitempty"`        // PDF, if owner asked for it
 }
 
 /*
@@ -48,6 +83,19 @@ Rich struct data to store in Redis
 Contain app id and URL to crawl
  */
 type URLRich struct {
-	Url   string `json:"url"`    // Page url tp crawl
-	AppID string `json:"app_id"` // App id of owner
+	Url      string        `json:"url"`      // Page url tp crawl
+	AppID    string        `json:"app_id"`   // App id of owner
+	Device   Device        `json:"device"`   // Device to render page for
+	Options  RenderOptions `json:"options"`  // How owner wants page to be rendered
+	Replicas int           `json:"replicas"` // Amount of independent peers to render page, for cross-verification
+
+	Priority  Priority `json:"priority"`             // Scheduling class, new pages are rendered before refreshes
+	NotBefore int64    `json:"not_before,omitempty"` // Unix time page can't be rendered before
+	Deadline  int64    `json:"deadline,omitempty"`   // Unix time page isn't needed after, 0 for none
+}
+
+// URL to crawl in batch, with token of its job
+type JobURL struct {
+	Token string `json:"token"`
+	URLRich
 }
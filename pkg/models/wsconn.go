@@ -2,42 +2,155 @@ package models
 
 import (
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	WS_WRITE_TIMEOUT = 10 * time.Second         // Max time to write one message
+	WS_PONG_TIMEOUT  = 60 * time.Second         // Connection is dead if nothing was read from server for this time
+	WS_PING_PERIOD   = WS_PONG_TIMEOUT * 9 / 10 // Pings have to be sent more often than pong timeout
+
+	WS_MAX_MESSAGE_SIZE = 64 << 20 // Max size of message, on wire and decompressed; pages carry screenshots and PDFs
+)
+
 type WSConn struct {
-	conn *websocket.Conn
-	mtx  *sync.Mutex
+	conn    *websocket.Conn
+	codec   Codec    // Encoding negotiated with server
+	proto   Protocol // Protocol negotiated with server
+	pending <-chan ReadResult
+	mtx     *sync.Mutex
+	once    *sync.Once
+	done    chan struct{}
+}
+
+// Message read from connection before it was wrapped, f.e. while waiting for hello
+type ReadResult struct {
+	Type int
+	Data []byte
+	Err  error
+}
+
+// Set up reading side of connection, it has to be done before anything is read,
+// as reads may be in progress aside while connection is wrapped
+func PrepareWSConn(c *websocket.Conn) {
+	c.SetReadLimit(WS_MAX_MESSAGE_SIZE)
+	// Every pong from server proves that connection is alive
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(WS_PONG_TIMEOUT))
+	})
 }
 
-// Creates new instance of websockets wrapper
-func NewWSConn(c *websocket.Conn) *WSConn {
-	return &WSConn{
-		conn: c,
-		mtx:  &sync.Mutex{},
+// Creates new instance of websockets wrapper, connection is prepared with PrepareWSConn
+func NewWSConn(c *websocket.Conn, codec Codec, proto Protocol) *WSConn {
+	w := &WSConn{
+		conn:  c,
+		codec: codec,
+		proto: proto,
+		mtx:   &sync.Mutex{},
+		once:  &sync.Once{},
+		done:  make(chan struct{}),
 	}
+	// Deadline is extended by pongs, it applies to read in progress too
+	c.SetReadDeadline(time.Now().Add(WS_PONG_TIMEOUT))
+	return w
 }
 
-// Allows to send messages in goroutines and avoid race condition and errors
+// Messages read before connection was wrapped, and read which is still in progress,
+// they're returned by ReadMessage until channel is closed. It has to be set before reading.
+func (w *WSConn) SetPending(c <-chan ReadResult) {
+	w.pending = c
+}
+
+// Allows to send messages in goroutines and avoid race condition and errors.
+// Connection is closed on error, it's unusable anyway.
 func (w *WSConn) WriteMessage(messageType int, data []byte) error {
 	w.mtx.Lock()
+	w.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
 	err := w.conn.WriteMessage(messageType, data)
 	w.mtx.Unlock()
+	if err != nil {
+		w.Close()
+	}
 	return err
 }
 
-// Just proxy of function
+// Read next message, connection is closed on error
 func (w *WSConn) ReadMessage() (messageType int, p []byte, err error) {
-	return w.conn.ReadMessage()
+	r, ok := ReadResult{}, false
+	if w.pending != nil {
+		if r, ok = <-w.pending; !ok {
+			w.pending = nil
+		}
+	}
+	if ok {
+		messageType, p, err = r.Type, r.Data, r.Err
+	} else {
+		messageType, p, err = w.conn.ReadMessage()
+	}
+	if err != nil {
+		w.Close()
+		return messageType, p, err
+	}
+	w.conn.SetReadDeadline(time.Now().Add(WS_PONG_TIMEOUT))
+	return messageType, p, nil
+}
+
+// Encode message with codec of connection and send it,
+// messages which server doesn't understand aren't sent
+func (w *WSConn) Send(m WSMessage) error {
+	if !w.proto.Supports(m.Type) {
+		return ERR_UNSUPPORTED_TYPE
+	}
+	b, err := w.codec.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return w.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// Read next message and decode it with codec of connection
+func (w *WSConn) Receive() (WSMessage, error) {
+	var m WSMessage
+	_, b, err := w.ReadMessage()
+	if err != nil {
+		return m, err
+	}
+	err = w.codec.Unmarshal(b, &m)
+	return m, err
+}
+
+// Codec negotiated with server
+func (w *WSConn) Codec() Codec {
+	return w.codec
 }
 
-// Just proxy of function
-func (w *WSConn) Ping() () {
-	return
+// Protocol negotiated with server
+func (w *WSConn) Protocol() Protocol {
+	return w.proto
 }
 
-// Close connection
+// Send ping, server answers with pong which extends read deadline
+func (w *WSConn) Ping() error {
+	w.mtx.Lock()
+	err := w.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WS_WRITE_TIMEOUT))
+	w.mtx.Unlock()
+	if err != nil {
+		w.Close()
+	}
+	return err
+}
+
+// Close connection, it's safe to call it many times
 func (w *WSConn) Close() {
-	w.conn.Close()
+	w.once.Do(func() {
+		close(w.done)
+		w.conn.Close()
+	})
+}
+
+// Closed when connection is closed
+func (w *WSConn) Done() <-chan struct{} {
+	return w.done
 }
@@ -0,0 +1,64 @@
+package processor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ContentHash is a hash of normalized page content.
+// Pages which differ only in scripts, comments, whitespace or render time have same hash,
+// so renders of same page by different peers may be compared.
+func ContentHash(pageURL string, body string) (string, error) {
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", ERR_INVALID_PAGE
+	}
+	p := Page{URL: pageURL, Doc: doc}
+	for _, step := range []func(*Page) error{StripScripts, Minify, stripVolatile} {
+		if err := step(&p); err != nil {
+			return "", err
+		}
+	}
+	var b bytes.Buffer
+	if err := html.Render(&b, p.Doc); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Remove parts which differ between renders of same page
+func stripVolatile(p *Page) error {
+	var remove []*html.Node
+	walk(p.Doc, func(n *html.Node) {
+		switch n.Type {
+		case html.ElementNode:
+			if n.DataAtom == atom.Meta && attr(n, "name") == META_PRERENDERED_AT {
+				remove = append(remove, n)
+				return
+			}
+			// Nonces are unique for every response
+			attrs := n.Attr[:0]
+			for _, a := range n.Attr {
+				if a.Key != "nonce" {
+					attrs = append(attrs, a)
+				}
+			}
+			n.Attr = attrs
+		case html.TextNode:
+			// Whitespace between elements depends on how page was serialized
+			if strings.TrimSpace(n.Data) == "" {
+				remove = append(remove, n)
+			}
+		}
+	})
+	for _, n := range remove {
+		n.Parent.RemoveChild(n)
+	}
+	return nil
+}
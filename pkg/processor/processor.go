@@ -0,0 +1,99 @@
+package processor
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+// Names of steps, used in config
+const (
+	STEP_STRIP_SCRIPTS         = "strip_scripts"
+	STEP_REMOVE_EVENT_HANDLERS = "remove_event_handlers"
+	STEP_BASE_HREF             = "base_href"
+	STEP_ABSOLUTIZE_URLS       = "absolutize_urls"
+	STEP_MINIFY                = "minify"
+	STEP_PRERENDERED_AT        = "prerendered_at"
+
+	ERR_UNKNOWN_STEP = models.Error("Unknown post-processing step")
+	ERR_PAGE_TOO_BIG = models.Error("Page exceeds size limit")
+	ERR_INVALID_PAGE = models.Error("Page isn't valid HTML")
+)
+
+// Page is a parsed rendered page
+type Page struct {
+	URL string     // URL of page, host and path as in cache
+	Doc *html.Node // Parsed document
+}
+
+// Processor changes page before it's stored
+type Processor interface {
+	Process(p *Page) error
+}
+
+// ProcessorFunc is an adapter to use ordinary functions as Processor
+type ProcessorFunc func(p *Page) error
+
+func (f ProcessorFunc) Process(p *Page) error {
+	return f(p)
+}
+
+// Known steps by name
+var steps = map[string]Processor{
+	STEP_STRIP_SCRIPTS:         ProcessorFunc(StripScripts),
+	STEP_REMOVE_EVENT_HANDLERS: ProcessorFunc(RemoveEventHandlers),
+	STEP_BASE_HREF:             ProcessorFunc(InjectBase),
+	STEP_ABSOLUTIZE_URLS:       ProcessorFunc(AbsolutizeURLs),
+	STEP_MINIFY:                ProcessorFunc(Minify),
+	STEP_PRERENDERED_AT:        ProcessorFunc(PrerenderedAt),
+}
+
+// Chain runs steps one by one and validates size of result
+type Chain struct {
+	steps   []Processor
+	maxSize int // Max size of page in bytes, 0 for unlimited
+}
+
+// Create chain of steps by their names
+func New(names []string, maxSize int) (*Chain, error) {
+	c := Chain{maxSize: maxSize}
+	for _, n := range names {
+		s, ok := steps[n]
+		if !ok {
+			return nil, ERR_UNKNOWN_STEP
+		}
+		c.steps = append(c.steps, s)
+	}
+	return &c, nil
+}
+
+// Process runs all steps against page HTML and returns result
+func (c *Chain) Process(url string, body string) (string, error) {
+	if c.maxSize > 0 && len(body) > c.maxSize {
+		return "", ERR_PAGE_TOO_BIG
+	}
+	if len(c.steps) == 0 {
+		return body, nil
+	}
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", ERR_INVALID_PAGE
+	}
+	p := Page{URL: url, Doc: doc}
+	for _, s := range c.steps {
+		if err := s.Process(&p); err != nil {
+			return "", err
+		}
+	}
+	var b bytes.Buffer
+	if err := html.Render(&b, p.Doc); err != nil {
+		return "", err
+	}
+	if c.maxSize > 0 && b.Len() > c.maxSize {
+		return "", ERR_PAGE_TOO_BIG
+	}
+	return b.String(), nil
+}
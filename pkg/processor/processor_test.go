@@ -0,0 +1,82 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	now = func() time.Time { return time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	c, err := New([]string{
+		STEP_STRIP_SCRIPTS,
+		STEP_REMOVE_EVENT_HANDLERS,
+		STEP_BASE_HREF,
+		STEP_ABSOLUTIZE_URLS,
+		STEP_MINIFY,
+		STEP_PRERENDERED_AT,
+	}, 0)
+	if err != nil {
+		t.Fatalf("Can't create chain: %v", err)
+	}
+
+	page := `<head><title>Page</title>
+		<script src="/app.js"></script>
+		<script type="application/ld+json">{"@type":"Thing"}</script>
+	</head>
+	<body onload="init()">
+		<!-- comment -->
+		<a href="about" onclick="go()">About</a>
+		<span one="1" only="yes" onion="true" ONMOUSEOVER="x()">Attrs</span>
+		<img src="/img.png" srcset="/img.png 1x, /img@2x.png 2x">
+		<pre>  keep   this  </pre>
+	</body>`
+
+	res, err := c.Process("example.com/blog/post", page)
+	if err != nil {
+		t.Fatalf("Can't process page: %v", err)
+	}
+
+	mustContain := []string{
+		`<base href="//example.com/blog/post"/>`,
+		`<script type="application/ld+json">`,
+		`<a href="//example.com/blog/about">About</a>`,
+		`src="//example.com/img.png"`,
+		`srcset="//example.com/img.png 1x, //example.com/img@2x.png 2x"`,
+		`<pre>  keep   this  </pre>`,
+		`<span one="1" only="yes" onion="true">Attrs</span>`,
+		`<meta name="prerendered-at" content="2019-01-02T03:04:05Z"/>`,
+	}
+	for _, s := range mustContain {
+		if !strings.Contains(res, s) {
+			t.Errorf("Result doesn't contain %s: %s", s, res)
+		}
+	}
+	mustNotContain := []string{"app.js", "onclick", "onload", "onmouseover", "comment", "\n"}
+	for _, s := range mustNotContain {
+		if strings.Contains(strings.Replace(res, "<pre>", "", 1), s) {
+			t.Errorf("Result contains %q: %s", s, res)
+		}
+	}
+}
+
+func TestChainUnknownStep(t *testing.T) {
+	if _, err := New([]string{"unknown"}, 0); err != ERR_UNKNOWN_STEP {
+		t.Fatalf("Unknown step is accepted")
+	}
+}
+
+func TestChainSizeLimit(t *testing.T) {
+	c, err := New(nil, 10)
+	if err != nil {
+		t.Fatalf("Can't create chain: %v", err)
+	}
+	if _, err := c.Process("example.com/", "<body>too big page</body>"); err != ERR_PAGE_TOO_BIG {
+		t.Fatalf("Page over size limit is accepted")
+	}
+	if _, err := c.Process("example.com/", "<b>ok</b>"); err != nil {
+		t.Fatalf("Page under size limit is rejected: %v", err)
+	}
+}
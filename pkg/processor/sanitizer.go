@@ -0,0 +1,199 @@
+package processor
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	ERR_FOREIGN_PAGE       = models.Error("Page URL doesn't belong to app")
+	ERR_CANONICAL_MISMATCH = models.Error("Canonical URL doesn't belong to app")
+	ERR_NO_APP_HOSTS       = models.Error("Hosts of app aren't configured")
+)
+
+// Sanitizer validates pages rendered by other (untrusted) network members.
+// Pages it rejects are suspicious and should never be served.
+type Sanitizer struct {
+	hosts   map[string]bool // Hosts of app, pages and canonical URLs must belong to them
+	trusted map[string]bool // Hosts allowed to serve scripts and frames, besides app hosts
+	maxSize int             // Max size of page in bytes, 0 for unlimited
+}
+
+// Create sanitizer for app hosts.
+// Pages are checked against app hosts only, so if they're empty every page is rejected.
+func NewSanitizer(hosts []string, trusted []string, maxSize int) *Sanitizer {
+	s := Sanitizer{
+		hosts:   make(map[string]bool),
+		trusted: make(map[string]bool),
+		maxSize: maxSize,
+	}
+	for _, h := range hosts {
+		s.hosts[strings.ToLower(h)] = true
+	}
+	for _, h := range trusted {
+		s.trusted[strings.ToLower(h)] = true
+	}
+	return &s
+}
+
+// Sanitize validates page and strips scripts, frames, styles and redirects of foreign origins
+func (s *Sanitizer) Sanitize(pageURL string, body string) (string, error) {
+	// Page can't be checked, but it isn't fault of peer
+	if len(s.hosts) == 0 {
+		return "", ERR_NO_APP_HOSTS
+	}
+	if s.maxSize > 0 && len(body) > s.maxSize {
+		return "", ERR_PAGE_TOO_BIG
+	}
+	page, err := url.Parse("//" + pageURL)
+	if err != nil || page.Host == "" {
+		return "", ERR_FOREIGN_PAGE
+	}
+	if !s.hosts[hostname(page)] {
+		return "", ERR_FOREIGN_PAGE
+	}
+	own := func(u *url.URL) bool {
+		return s.hosts[hostname(u)]
+	}
+	loadable := func(u *url.URL) bool {
+		return own(u) || s.trusted[hostname(u)]
+	}
+
+	doc, err := html.Parse(strings.NewReader(body))
+	if err != nil {
+		return "", ERR_INVALID_PAGE
+	}
+
+	var foreign []*html.Node
+	// Browser resolves every URL of page against first <base> with href,
+	// so foreign ones are stripped and refs are resolved against own one
+	base := page
+	walk(doc, func(n *html.Node) {
+		if n.Type != html.ElementNode || n.DataAtom != atom.Base || attr(n, "href") == "" {
+			return
+		}
+		if !s.allowed(page, attr(n, "href"), own) {
+			foreign = append(foreign, n)
+			return
+		}
+		if base == page {
+			base = resolveURL(page, attr(n, "href"))
+		}
+	})
+
+	var mismatch bool
+	walk(doc, func(n *html.Node) {
+		if n.Type != html.ElementNode {
+			return
+		}
+		switch n.DataAtom {
+		case atom.Link:
+			rel := relTypes(n)
+			if rel["canonical"] && !s.allowed(base, attr(n, "href"), own) {
+				mismatch = true
+			}
+			if (rel["stylesheet"] || rel["preload"] || rel["modulepreload"] || rel["import"]) && !s.allowed(base, attr(n, "href"), loadable) {
+				foreign = append(foreign, n)
+			}
+		case atom.Meta:
+			if attr(n, "property") == "og:url" && !s.allowed(base, attr(n, "content"), own) {
+				mismatch = true
+			}
+			if strings.EqualFold(attr(n, "http-equiv"), "refresh") && !s.allowed(base, refreshURL(attr(n, "content")), own) {
+				foreign = append(foreign, n)
+			}
+		case atom.Iframe:
+			// Inline document isn't checked, so it's never trusted
+			if attr(n, "srcdoc") != "" || !s.allowed(base, attr(n, "src"), loadable) {
+				foreign = append(foreign, n)
+			}
+		case atom.Script, atom.Frame, atom.Embed:
+			if !s.allowed(base, attr(n, "src"), loadable) {
+				foreign = append(foreign, n)
+			}
+		case atom.Object:
+			if !s.allowed(base, attr(n, "data"), loadable) {
+				foreign = append(foreign, n)
+			}
+		}
+	})
+	if mismatch {
+		return "", ERR_CANONICAL_MISMATCH
+	}
+	for _, n := range foreign {
+		if n.Parent != nil {
+			n.Parent.RemoveChild(n)
+		}
+	}
+
+	var b bytes.Buffer
+	if err := html.Render(&b, doc); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Check that URL from page is relative or points to allowed host
+func (s *Sanitizer) allowed(base *url.URL, ref string, ok func(*url.URL) bool) bool {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return true
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return false
+	}
+	u = base.ResolveReference(u)
+	// Inline content, f.e. data: or javascript: URLs, has no origin to check
+	if u.Host == "" {
+		return u.Scheme == "" || u.Scheme == "data"
+	}
+	return ok(u)
+}
+
+// Absolute URL of ref, base if it's invalid
+func resolveURL(base *url.URL, ref string) *url.URL {
+	u, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return base
+	}
+	return base.ResolveReference(u)
+}
+
+// Link types of element, rel is space separated list
+func relTypes(n *html.Node) map[string]bool {
+	rel := make(map[string]bool)
+	for _, r := range strings.Fields(attr(n, "rel")) {
+		rel[strings.ToLower(r)] = true
+	}
+	return rel
+}
+
+// URL of meta refresh, its content is "<seconds>; url=<URL>", URL may be quoted
+func refreshURL(content string) string {
+	i := strings.Index(content, ";")
+	if i < 0 {
+		i = strings.Index(content, ",")
+	}
+	if i < 0 {
+		return ""
+	}
+	ref := strings.TrimSpace(content[i+1:])
+	if len(ref) >= 4 && strings.EqualFold(ref[:3], "url") {
+		if rest := strings.TrimSpace(ref[3:]); strings.HasPrefix(rest, "=") {
+			ref = strings.TrimSpace(rest[1:])
+		}
+	}
+	return strings.Trim(ref, "'\"")
+}
+
+// Lowercase host without port
+func hostname(u *url.URL) string {
+	return strings.ToLower(u.Hostname())
+}
@@ -0,0 +1,91 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	s := NewSanitizer([]string{"example.com", "www.example.com"}, []string{"cdn.example.net"}, 1000)
+
+	page := `<head>
+		<link rel="canonical" href="https://www.example.com/post">
+		<script src="/app.js"></script>
+		<script src="https://cdn.example.net/lib.js"></script>
+		<script src="https://evil.com/miner.js"></script>
+	</head>
+	<body><iframe src="//evil.com/frame"></iframe><p>Post</p></body>`
+
+	res, err := s.Sanitize("example.com/post", page)
+	if err != nil {
+		t.Fatalf("Valid page is rejected: %v", err)
+	}
+	for _, str := range []string{"/app.js", "cdn.example.net/lib.js", "<p>Post</p>"} {
+		if !strings.Contains(res, str) {
+			t.Errorf("Result doesn't contain %s: %s", str, res)
+		}
+	}
+	if strings.Contains(res, "evil.com") {
+		t.Errorf("Foreign script or frame isn't stripped: %s", res)
+	}
+}
+
+func TestSanitizeSuspicious(t *testing.T) {
+	s := NewSanitizer([]string{"example.com"}, nil, 100)
+
+	cases := []struct {
+		name string
+		url  string
+		page string
+		err  error
+	}{
+		{"foreign page", "evil.com/post", `<p>Post</p>`, ERR_FOREIGN_PAGE},
+		{"foreign canonical", "example.com/post", `<link rel="canonical" href="https://evil.com/post">`, ERR_CANONICAL_MISMATCH},
+		{"foreign og:url", "example.com/post", `<meta property="og:url" content="https://evil.com/post">`, ERR_CANONICAL_MISMATCH},
+		{"too big", "example.com/post", strings.Repeat("<p>Post</p>", 20), ERR_PAGE_TOO_BIG},
+		{"canonical among rels", "example.com/post", `<link rel="Canonical alternate" href="https://evil.com/post">`, ERR_CANONICAL_MISMATCH},
+	}
+	for _, c := range cases {
+		if _, err := s.Sanitize(c.url, c.page); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestSanitizeNoHosts(t *testing.T) {
+	s := NewSanitizer(nil, nil, 0)
+	if _, err := s.Sanitize("example.com/post", `<p>Post</p>`); err != ERR_NO_APP_HOSTS {
+		t.Fatalf("Expected page to be rejected without app hosts, got %v", err)
+	}
+}
+
+func TestSanitizeForeignRefs(t *testing.T) {
+	s := NewSanitizer([]string{"example.com"}, nil, 0)
+
+	cases := []struct {
+		name string
+		page string
+	}{
+		{"base", `<head><base href="//evil.com/"><script src="/app.js"></script></head>`},
+		{"refresh", `<head><meta http-equiv="Refresh" content="0; url='https://evil.com/'"></head>`},
+		{"stylesheet", `<head><link rel="stylesheet" href="https://evil.com/style.css"></head>`},
+		{"preload", `<head><link rel="modulepreload" href="//evil.com/mod.js"></head>`},
+		{"srcdoc", `<body><iframe srcdoc="&lt;script src=https://evil.com/x.js&gt;&lt;/script&gt;"></iframe></body>`},
+	}
+	for _, c := range cases {
+		res, err := s.Sanitize("example.com/post", c.page)
+		if err != nil {
+			t.Errorf("%s: page is rejected: %v", c.name, err)
+			continue
+		}
+		if strings.Contains(res, "evil.com") {
+			t.Errorf("%s: foreign ref isn't stripped: %s", c.name, res)
+		}
+	}
+
+	// Refs are resolved against own base
+	res, err := s.Sanitize("example.com/post", `<head><base href="/static/"><script src="app.js"></script><meta http-equiv="refresh" content="5"></head>`)
+	if err != nil || !strings.Contains(res, "app.js") || !strings.Contains(res, "refresh") {
+		t.Fatalf("Own refs are stripped: %v %s", err, res)
+	}
+}
@@ -0,0 +1,292 @@
+package processor
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	META_PRERENDERED_AT = "prerendered-at"
+
+	SCRIPT_TYPE_LD_JSON = "application/ld+json" // Structured data for bots, never stripped
+)
+
+var (
+	now = time.Now
+
+	// Attributes which contain URLs
+	urlAttrs = map[string]bool{
+		"href":   true,
+		"src":    true,
+		"action": true,
+		"poster": true,
+	}
+
+	// Inline event handler attributes, from HTML and DOM specs.
+	// Only they are stripped, so attributes like "one" or "only" are kept
+	eventHandlers = map[string]bool{
+		"onabort": true, "onafterprint": true, "onanimationcancel": true, "onanimationend": true,
+		"onanimationiteration": true, "onanimationstart": true, "onauxclick": true, "onbeforecopy": true,
+		"onbeforecut": true, "onbeforeinput": true, "onbeforematch": true, "onbeforepaste": true,
+		"onbeforeprint": true, "onbeforetoggle": true, "onbeforeunload": true, "onblur": true, "oncancel": true,
+		"oncanplay": true, "oncanplaythrough": true, "onchange": true, "onclick": true, "onclose": true,
+		"oncompositionend": true, "oncompositionstart": true, "oncompositionupdate": true, "oncontextlost": true,
+		"oncontextmenu": true, "oncontextrestored": true, "oncopy": true, "oncuechange": true, "oncut": true,
+		"ondblclick": true, "ondrag": true, "ondragend": true, "ondragenter": true, "ondragexit": true,
+		"ondragleave": true, "ondragover": true, "ondragstart": true, "ondrop": true, "ondurationchange": true,
+		"onemptied": true, "onended": true, "onerror": true, "onfocus": true, "onfocusin": true,
+		"onfocusout": true, "onformdata": true, "onfullscreenchange": true, "onfullscreenerror": true,
+		"ongotpointercapture": true, "onhashchange": true, "oninput": true, "oninvalid": true, "onkeydown": true,
+		"onkeypress": true, "onkeyup": true, "onlanguagechange": true, "onload": true, "onloadeddata": true,
+		"onloadedmetadata": true, "onloadend": true, "onloadstart": true, "onlostpointercapture": true,
+		"onmessage": true, "onmessageerror": true, "onmousedown": true, "onmouseenter": true, "onmouseleave": true,
+		"onmousemove": true, "onmouseout": true, "onmouseover": true, "onmouseup": true, "onmousewheel": true,
+		"onoffline": true, "ononline": true, "onpagehide": true, "onpagereveal": true, "onpageshow": true,
+		"onpageswap": true, "onpaste": true, "onpause": true, "onplay": true, "onplaying": true,
+		"onpointercancel": true, "onpointerdown": true, "onpointerenter": true, "onpointerleave": true,
+		"onpointermove": true, "onpointerout": true, "onpointerover": true, "onpointerrawupdate": true,
+		"onpointerup": true, "onpopstate": true, "onprogress": true, "onratechange": true,
+		"onrejectionhandled": true, "onreset": true, "onresize": true, "onscroll": true, "onscrollend": true,
+		"onsearch": true, "onsecuritypolicyviolation": true, "onseeked": true, "onseeking": true, "onselect": true,
+		"onselectionchange": true, "onselectstart": true, "onshow": true, "onslotchange": true, "onstalled": true,
+		"onstorage": true, "onsubmit": true, "onsuspend": true, "ontimeupdate": true, "ontoggle": true,
+		"ontouchcancel": true, "ontouchend": true, "ontouchmove": true, "ontouchstart": true,
+		"ontransitioncancel": true, "ontransitionend": true, "ontransitionrun": true, "ontransitionstart": true,
+		"onunhandledrejection": true, "onunload": true, "onvisibilitychange": true, "onvolumechange": true,
+		"onwaiting": true, "onwebkitanimationend": true, "onwebkitanimationiteration": true,
+		"onwebkitanimationstart": true, "onwebkittransitionend": true, "onwheel": true,
+	}
+
+	whitespaceRE = regexp.MustCompile(`\s+`)
+)
+
+// Remove scripts, page is already rendered and bots don't need them.
+// Structured data is kept.
+func StripScripts(p *Page) error {
+	var scripts []*html.Node
+	walk(p.Doc, func(n *html.Node) {
+		if n.Type == html.ElementNode && n.DataAtom == atom.Script && attr(n, "type") != SCRIPT_TYPE_LD_JSON {
+			scripts = append(scripts, n)
+		}
+	})
+	for _, s := range scripts {
+		s.Parent.RemoveChild(s)
+	}
+	return nil
+}
+
+// Remove inline event handlers, like onclick
+func RemoveEventHandlers(p *Page) error {
+	walk(p.Doc, func(n *html.Node) {
+		if n.Type != html.ElementNode {
+			return
+		}
+		attrs := n.Attr[:0]
+		for _, a := range n.Attr {
+			if !eventHandlers[strings.ToLower(a.Key)] {
+				attrs = append(attrs, a)
+			}
+		}
+		n.Attr = attrs
+	})
+	return nil
+}
+
+// Add <base href> pointing to page itself, if page has no base,
+// so relative URLs resolve same way wherever page is served
+func InjectBase(p *Page) error {
+	if find(p.Doc, atom.Base) != nil {
+		return nil
+	}
+	u, err := pageURL(p)
+	if err != nil {
+		return err
+	}
+	u.Fragment = ""
+	head := find(p.Doc, atom.Head)
+	if head == nil {
+		return ERR_INVALID_PAGE
+	}
+	base := &html.Node{
+		Type:     html.ElementNode,
+		Data:     "base",
+		DataAtom: atom.Base,
+		Attr:     []html.Attribute{{Key: "href", Val: u.String()}},
+	}
+	head.InsertBefore(base, head.FirstChild)
+	return nil
+}
+
+// Make relative URLs absolute, so page works wherever it's served
+func AbsolutizeURLs(p *Page) error {
+	base, err := pageURL(p)
+	if err != nil {
+		return err
+	}
+	// Respect base of page itself
+	if b := find(p.Doc, atom.Base); b != nil {
+		if href := attr(b, "href"); href != "" {
+			if bu, err := url.Parse(href); err == nil {
+				base = base.ResolveReference(bu)
+			}
+		}
+	}
+	walk(p.Doc, func(n *html.Node) {
+		if n.Type != html.ElementNode || n.DataAtom == atom.Base {
+			return
+		}
+		for i, a := range n.Attr {
+			switch {
+			case urlAttrs[a.Key]:
+				n.Attr[i].Val = resolve(base, a.Val)
+			case a.Key == "srcset":
+				n.Attr[i].Val = resolveSrcset(base, a.Val)
+			}
+		}
+	})
+	return nil
+}
+
+// Remove comments and collapse whitespace, content of pre, textarea, script and style is kept as is
+func Minify(p *Page) error {
+	var remove []*html.Node
+	walk(p.Doc, func(n *html.Node) {
+		switch n.Type {
+		case html.CommentNode:
+			remove = append(remove, n)
+		case html.TextNode:
+			if preformatted(n) {
+				return
+			}
+			n.Data = whitespaceRE.ReplaceAllString(n.Data, " ")
+			// Whitespace between head elements is never rendered
+			if n.Data == " " && n.Parent != nil && (n.Parent.DataAtom == atom.Head || n.Parent.DataAtom == atom.Html) {
+				remove = append(remove, n)
+			}
+		}
+	})
+	for _, n := range remove {
+		n.Parent.RemoveChild(n)
+	}
+	return nil
+}
+
+// Add <meta name="prerendered-at"> with time of processing
+func PrerenderedAt(p *Page) error {
+	head := find(p.Doc, atom.Head)
+	if head == nil {
+		return ERR_INVALID_PAGE
+	}
+	ts := now().UTC().Format(time.RFC3339)
+	// Update existing tag, f.e. if page was processed twice
+	var meta *html.Node
+	walk(head, func(n *html.Node) {
+		if meta == nil && n.DataAtom == atom.Meta && attr(n, "name") == META_PRERENDERED_AT {
+			meta = n
+		}
+	})
+	if meta != nil {
+		setAttr(meta, "content", ts)
+		return nil
+	}
+	head.AppendChild(&html.Node{
+		Type:     html.ElementNode,
+		Data:     "meta",
+		DataAtom: atom.Meta,
+		Attr: []html.Attribute{
+			{Key: "name", Val: META_PRERENDERED_AT},
+			{Key: "content", Val: ts},
+		},
+	})
+	return nil
+}
+
+// Page URL is stored without scheme, so it's protocol relative
+func pageURL(p *Page) (*url.URL, error) {
+	return url.Parse("//" + p.URL)
+}
+
+// Resolve URL against base, fragments and URLs with scheme are kept
+func resolve(base *url.URL, ref string) string {
+	ref = strings.TrimSpace(ref)
+	if ref == "" || strings.HasPrefix(ref, "#") {
+		return ref
+	}
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ref
+	}
+	return base.ResolveReference(u).String()
+}
+
+// Resolve every candidate of srcset, "img.png 1x, img@2x.png 2x"
+func resolveSrcset(base *url.URL, srcset string) string {
+	candidates := strings.Split(srcset, ",")
+	for i, c := range candidates {
+		parts := strings.Fields(c)
+		if len(parts) == 0 {
+			continue
+		}
+		parts[0] = resolve(base, parts[0])
+		candidates[i] = strings.Join(parts, " ")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// Text in these elements is whitespace sensitive
+func preformatted(n *html.Node) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		switch p.DataAtom {
+		case atom.Pre, atom.Textarea, atom.Script, atom.Style:
+			return true
+		}
+	}
+	return false
+}
+
+// Walk all nodes depth first
+func walk(n *html.Node, fn func(*html.Node)) {
+	fn(n)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walk(c, fn)
+	}
+}
+
+// Find first element
+func find(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if f := find(c, a); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// Get value of attribute
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// Set value of attribute, adding it if needed
+func setAttr(n *html.Node, key string, val string) {
+	for i, a := range n.Attr {
+		if a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
@@ -0,0 +1,146 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp/client"
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	INTERCEPT_TIMEOUT = 5 * time.Second // Max time to enable interception before page is loaded
+
+	ERR_NO_PAGE_TARGET = models.Error("Chrome has no page to render in")
+)
+
+// Chrome resource types of blocked resources
+var resourceTypes = map[string]network.ResourceType{
+	models.RESOURCE_IMAGE:      network.ResourceTypeImage,
+	models.RESOURCE_MEDIA:      network.ResourceTypeMedia,
+	models.RESOURCE_FONT:       network.ResourceTypeFont,
+	models.RESOURCE_STYLESHEET: network.ResourceTypeStylesheet,
+}
+
+// DevTools message, only fields used by interceptor
+type cdpMessage struct {
+	ID     int64           `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Error  json.RawMessage `json:"error,omitempty"`
+}
+
+/*
+Intercept requests of page for blocked resource types and abort them,
+so resources are blocked by how they're used, not by URL.
+chromedp doesn't deliver network events, so interceptor uses own DevTools connection to page,
+interception is enabled once this returns and lasts until stop is called.
+*/
+func intercept(ctx context.Context, wsURL string, blocked []string) (stop func(), err error) {
+	var patterns []*network.RequestPattern
+	for _, r := range blocked {
+		if t, ok := resourceTypes[r]; ok {
+			patterns = append(patterns, &network.RequestPattern{URLPattern: "*", ResourceType: t})
+		}
+	}
+	if len(patterns) == 0 {
+		return func() {}, nil
+	}
+	conn, err := client.Dial(wsURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "intercept: client.Dial:")
+	}
+	var mtx sync.Mutex
+	var seq int64
+	send := func(method string, params interface{}) (int64, error) {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return 0, err
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		seq++
+		m, err := json.Marshal(cdpMessage{ID: seq, Method: method, Params: b})
+		if err != nil {
+			return 0, err
+		}
+		return seq, conn.Write(m)
+	}
+
+	id, err := send(network.CommandSetRequestInterception, network.SetRequestInterception(patterns))
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "intercept: send:")
+	}
+	// Only first result is awaited, reader never blocks on later ones
+	enabled := make(chan error, 1)
+	done := func(err error) {
+		select {
+		case enabled <- err:
+		default:
+		}
+	}
+	go func() {
+		for {
+			b, err := conn.Read()
+			if err != nil {
+				done(err)
+				return
+			}
+			var m cdpMessage
+			if err := json.Unmarshal(b, &m); err != nil {
+				continue
+			}
+			switch {
+			case m.ID == id:
+				if len(m.Error) > 0 {
+					done(errors.New(string(m.Error)))
+					continue
+				}
+				done(nil)
+			case m.Method == string(cdproto.EventNetworkRequestIntercepted):
+				var e network.EventRequestIntercepted
+				if err := json.Unmarshal(m.Params, &e); err != nil {
+					continue
+				}
+				p := network.ContinueInterceptedRequest(e.InterceptionID)
+				// Page itself is never blocked
+				if !e.IsNavigationRequest {
+					p = p.WithErrorReason(network.ErrorReasonBlockedByClient)
+				}
+				send(network.CommandContinueInterceptedRequest, p)
+			}
+		}
+	}()
+
+	select {
+	case err = <-enabled:
+	case <-time.After(INTERCEPT_TIMEOUT):
+		err = context.DeadlineExceeded
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "intercept:")
+	}
+	return func() { conn.Close() }, nil
+}
+
+// DevTools URL of page of Chrome, which is listening at url
+func pageWebsocket(ctx context.Context, url string) (string, error) {
+	targets, err := client.New(client.URL(url)).ListPageTargets(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "pageWebsocket: ListPageTargets:")
+	}
+	if len(targets) == 0 {
+		return "", ERR_NO_PAGE_TARGET
+	}
+	return targets[0].GetWebsocketURL(), nil
+}
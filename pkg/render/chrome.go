@@ -0,0 +1,119 @@
+package render
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/chromedp/chromedp"
+	"github.com/chromedp/chromedp/runner"
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/config"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	CHROME_PORTS = 100 // Debugging ports reserved for Chrome launched by broker, one per page rendered at once
+
+	ERR_CHROME_PORT = models.Error("Debugging port for Chrome is taken")
+)
+
+/*
+Chrome renders pages in Chrome launched by this process,
+new instance with clean profile is launched for every page.
+*/
+type Chrome struct {
+	pool        *chromedp.Pool
+	opts        []runner.CommandLineOption // Chrome launch options
+	userDataDir string                     // Base dir for profiles, Chrome locks profile, so every instance needs own one
+
+	mtx sync.Mutex
+	seq int
+}
+
+// Create Chrome renderer, instances use debugging ports from start up to end
+func NewChrome(cfg *config.RenderConfig, start int, end int) (*Chrome, error) {
+	pool, err := chromedp.NewPool(chromedp.PortRange(start, end))
+	if err != nil {
+		return nil, errors.Wrap(err, "NewChrome: chromedp.NewPool:")
+	}
+	return &Chrome{
+		pool:        pool,
+		opts:        chromeOptions(cfg),
+		userDataDir: cfg.UserDataDir,
+	}, nil
+}
+
+func (c *Chrome) Render(ctx context.Context, req models.RenderRequest) (models.RenderResult, error) {
+	opts := c.opts[:len(c.opts):len(c.opts)]
+	if c.userDataDir != "" {
+		opts = append(opts, runner.UserDataDir(c.nextDir()))
+	}
+	r, err := c.pool.Allocate(ctx, opts...)
+	if err != nil {
+		// Pool checks that port is free before launching Chrome
+		if _, ok := err.(*net.OpError); ok {
+			return models.RenderResult{}, ERR_CHROME_PORT
+		}
+		return models.RenderResult{}, errors.Wrap(err, "Render: pool.Allocate:")
+	}
+	defer r.Release()
+
+	ctx, cancel := withTimeout(ctx, req)
+	defer cancel()
+	ws, err := pageWebsocket(ctx, r.URL())
+	if err != nil {
+		return models.RenderResult{}, timeout(ctx, err)
+	}
+	return run(ctx, r, ws, req)
+}
+
+// Close all Chrome instances
+func (c *Chrome) Close() {
+	c.pool.Shutdown()
+}
+
+// Profile dir for next instance
+func (c *Chrome) nextDir() string {
+	c.mtx.Lock()
+	c.seq++
+	seq := c.seq
+	c.mtx.Unlock()
+	return filepath.Join(c.userDataDir, fmt.Sprintf("%d-%d", os.Getpid(), seq))
+}
+
+// Chrome launch options from config
+func chromeOptions(cfg *config.RenderConfig) []runner.CommandLineOption {
+	opts := []runner.CommandLineOption{
+		runner.Flag("headless", cfg.Headless),
+		runner.Flag("no-sandbox", cfg.NoSandbox),
+		runner.Flag("disable-gpu", cfg.DisableGPU),
+	}
+	if cfg.ChromeBin != "" {
+		opts = append(opts, runner.ExecPath(cfg.ChromeBin))
+	}
+	if cfg.Proxy != "" {
+		opts = append(opts, runner.ProxyServer(cfg.Proxy))
+	}
+	if cfg.WindowWidth > 0 && cfg.WindowHeight > 0 {
+		opts = append(opts, runner.WindowSize(cfg.WindowWidth, cfg.WindowHeight))
+	}
+	for _, f := range cfg.ChromeFlags {
+		f = strings.TrimLeft(strings.TrimSpace(f), "-")
+		if f == "" {
+			continue
+		}
+		// Flag without value is a switch
+		if kv := strings.SplitN(f, "=", 2); len(kv) == 2 {
+			opts = append(opts, runner.Flag(kv[0], kv[1]))
+		} else {
+			opts = append(opts, runner.Flag(f, true))
+		}
+	}
+	return opts
+}
@@ -0,0 +1,31 @@
+package render
+
+import (
+	"context"
+	"time"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+/*
+Fake renders pages without browser, for tests.
+Page is rendered after delay, it times out like real render if delay is longer than timeout.
+*/
+type Fake struct {
+	Delay  time.Duration
+	Result func(req models.RenderRequest) (models.RenderResult, error) // Result of render, page with URL in body if it's nil
+}
+
+func (f *Fake) Render(ctx context.Context, req models.RenderRequest) (models.RenderResult, error) {
+	ctx, cancel := withTimeout(ctx, req)
+	defer cancel()
+	select {
+	case <-time.After(f.Delay):
+	case <-ctx.Done():
+		return models.RenderResult{}, timeout(ctx, ctx.Err())
+	}
+	if f.Result != nil {
+		return f.Result(req)
+	}
+	return models.RenderResult{HTML: "<html><head></head><body>" + req.URL + "</body></html>"}, nil
+}
@@ -0,0 +1,53 @@
+package render
+
+import (
+	"context"
+
+	"github.com/chromedp/chromedp"
+	"github.com/chromedp/chromedp/client"
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+/*
+Remote renders pages in Chrome running elsewhere, f.e. in other container,
+via its DevTools endpoint. New tab is opened for every page and closed after.
+*/
+type Remote struct {
+	url string
+}
+
+// Create remote renderer, url is DevTools endpoint, f.e. http://chrome:9222/json
+func NewRemote(url string) *Remote {
+	return &Remote{url: url}
+}
+
+func (r *Remote) Render(ctx context.Context, req models.RenderRequest) (models.RenderResult, error) {
+	// Connection to tab is closed with context
+	ctx, cancel := withTimeout(ctx, req)
+	defer cancel()
+
+	cl := client.New(client.URL(r.url))
+	t, err := cl.NewPageTarget(ctx)
+	if err != nil {
+		return models.RenderResult{}, errors.Wrap(timeout(ctx, err), "Render: NewPageTarget:")
+	}
+	defer cl.CloseTarget(context.Background(), t)
+
+	// Handler of tab runs until its context is done, it's stopped before tab is closed
+	cdpCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	targets := make(chan client.Target, 1)
+	targets <- t
+	close(targets)
+	c, err := chromedp.New(cdpCtx, chromedp.WithTargets(targets))
+	if err != nil {
+		return models.RenderResult{}, errors.Wrap(timeout(ctx, err), "Render: chromedp.New:")
+	}
+	defer func() {
+		stop()
+		c.Wait()
+	}()
+	return run(ctx, c, t.GetWebsocketURL(), req)
+}
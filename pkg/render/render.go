@@ -0,0 +1,45 @@
+// Package render renders pages in headless Chrome, launched by this process or running elsewhere
+package render
+
+import (
+	"context"
+
+	"github.com/chromedp/chromedp"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+// Page target of Chrome which runs actions
+type target interface {
+	Run(ctx context.Context, a chromedp.Action) error
+}
+
+// Run render tasks in page at wsURL, result is returned only on success, so partial result never leaks
+func run(ctx context.Context, r target, wsURL string, req models.RenderRequest) (models.RenderResult, error) {
+	stop, err := intercept(ctx, wsURL, req.Options.BlockResources)
+	if err != nil {
+		return models.RenderResult{}, timeout(ctx, err)
+	}
+	defer stop()
+	var res models.RenderResult
+	if err := r.Run(ctx, renderTasks(req, &res)); err != nil {
+		return models.RenderResult{}, timeout(ctx, err)
+	}
+	return res, nil
+}
+
+// Error of render, ERR_RENDER_TIMEOUT if it's caused by timeout of request
+func timeout(ctx context.Context, err error) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return models.ERR_RENDER_TIMEOUT
+	}
+	return err
+}
+
+// Context limited by timeout of request, if it's set
+func withTimeout(ctx context.Context, req models.RenderRequest) (context.Context, context.CancelFunc) {
+	if req.Timeout > 0 {
+		return context.WithTimeout(ctx, req.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
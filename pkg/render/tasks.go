@@ -0,0 +1,156 @@
+package render
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/chromedp"
+
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+// Tasks to render page and capture its source and side outputs into result
+func renderTasks(req models.RenderRequest, res *models.RenderResult) chromedp.Tasks {
+	return chromedp.Tasks{
+		emulateTasks(req.Device),
+		blockTasks(req.Options),
+		injectTasks(req),
+		chromedp.Navigate(req.URL),
+		chromedp.Sleep(2 * time.Second),
+		postScriptTasks(req.Options),
+		chromedp.InnerHTML("html", &res.HTML),
+		captureTasks(req, res),
+	}
+}
+
+// Set headers, cookies, localStorage and pre-navigate script
+func injectTasks(req models.RenderRequest) chromedp.Tasks {
+	var tasks chromedp.Tasks
+	opts := req.Options
+	if len(opts.Headers) > 0 {
+		headers := make(network.Headers, len(opts.Headers))
+		for k, v := range opts.Headers {
+			headers[k] = v
+		}
+		tasks = append(tasks, network.Enable(), network.SetExtraHTTPHeaders(headers))
+	}
+	for _, c := range opts.Cookies {
+		c := c
+		tasks = append(tasks, chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+			p := network.SetCookie(c.Name, c.Value)
+			// Without domain cookie belongs to page host
+			if c.Domain != "" {
+				p = p.WithDomain(c.Domain)
+			} else {
+				p = p.WithURL(req.URL)
+			}
+			if c.Path != "" {
+				p = p.WithPath(c.Path)
+			}
+			_, err := p.Do(ctxt, h)
+			return err
+		}))
+	}
+	// Scripts evaluated on new document run before page scripts,
+	// so page sees localStorage entries already set
+	var scripts []string
+	if len(opts.LocalStorage) > 0 {
+		entries, err := json.Marshal(opts.LocalStorage)
+		if err == nil {
+			scripts = append(scripts, "(function(e){for(var k in e){try{localStorage.setItem(k,e[k])}catch(_){}}})("+string(entries)+");")
+		}
+	}
+	if opts.PreScript != "" {
+		scripts = append(scripts, opts.PreScript)
+	}
+	for _, s := range scripts {
+		s := s
+		tasks = append(tasks, chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+			_, err := page.AddScriptToEvaluateOnNewDocument(s).Do(ctxt, h)
+			return err
+		}))
+	}
+	return tasks
+}
+
+// Evaluate post-load script, page source is captured after it
+func postScriptTasks(opts models.RenderOptions) chromedp.Tasks {
+	if opts.PostScript == "" {
+		return nil
+	}
+	var res []byte
+	return chromedp.Tasks{chromedp.Evaluate(opts.PostScript, &res)}
+}
+
+// Capture screenshot and PDF of rendered page, if app asked for them
+func captureTasks(req models.RenderRequest, res *models.RenderResult) chromedp.Tasks {
+	var tasks chromedp.Tasks
+	switch req.Options.Screenshot {
+	case models.SCREENSHOT_VIEWPORT:
+		tasks = append(tasks, chromedp.CaptureScreenshot(&res.Screenshot))
+	case models.SCREENSHOT_FULL:
+		tasks = append(tasks, chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+			// Stretch viewport to whole content, so everything is painted
+			_, _, size, err := page.GetLayoutMetrics().Do(ctxt, h)
+			if err != nil {
+				return err
+			}
+			d := req.Device
+			if d.Scale == 0 {
+				d.Scale = 1
+			}
+			width, height := int64(math.Ceil(size.Width)), int64(math.Ceil(size.Height))
+			if err := emulation.SetDeviceMetricsOverride(width, height, d.Scale, d.Mobile).Do(ctxt, h); err != nil {
+				return err
+			}
+			res.Screenshot, err = page.CaptureScreenshot().
+				WithClip(&page.Viewport{Width: size.Width, Height: size.Height, Scale: 1}).
+				Do(ctxt, h)
+			return err
+		}))
+	}
+	if req.Options.PDF {
+		tasks = append(tasks, chromedp.ActionFunc(func(ctxt context.Context, h cdp.Executor) error {
+			var err error
+			res.PDF, err = page.PrintToPDF().WithPrintBackground(true).Do(ctxt, h)
+			return err
+		}))
+	}
+	return tasks
+}
+
+// Emulate viewport and user agent of device before navigation
+func emulateTasks(d models.Device) chromedp.Tasks {
+	if d.Width == 0 || d.Height == 0 {
+		d = models.DeviceByName(d.Name)
+	}
+	if d.Scale == 0 {
+		d.Scale = 1
+	}
+	tasks := chromedp.Tasks{
+		emulation.SetDeviceMetricsOverride(d.Width, d.Height, d.Scale, d.Mobile),
+		emulation.SetTouchEmulationEnabled(d.Mobile),
+	}
+	if d.UserAgent != "" {
+		tasks = append(tasks, emulation.SetUserAgentOverride(d.UserAgent))
+	}
+	return tasks
+}
+
+// Block heavy resources and third party trackers, they aren't needed for page source
+func blockTasks(opts models.RenderOptions) chromedp.Tasks {
+	// Resource types are blocked by interceptor
+	if len(opts.BlockURLs) == 0 {
+		return nil
+	}
+	return chromedp.Tasks{
+		network.Enable(),
+		network.SetBlockedURLS(opts.BlockURLs),
+	}
+}
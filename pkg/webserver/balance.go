@@ -0,0 +1,55 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/c12o16h1/shender/pkg/cache"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	PATH_BALANCE = "/debug/balance" // Served on debug listener only
+
+	CONTENT_TYPE_JSON = "application/json"
+)
+
+// Render credits of this app, as counted by broker and as reported by server
+type balances struct {
+	Local  *models.Balance `json:"local"`
+	Server *models.Balance `json:"server"` // Absent until server reported it
+}
+
+// BalanceHandler serves render credits of this app as JSON
+func BalanceHandler(cacher cache.Cacher) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		local, err := readBalance(cacher, models.CREDITS_LOCAL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		server, err := readBalance(cacher, models.CREDITS_SERVER)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", CONTENT_TYPE_JSON)
+		json.NewEncoder(w).Encode(balances{Local: local, Server: server})
+	})
+}
+
+// Balance stored in cache, nil if there is none yet
+func readBalance(cacher cache.Cacher, key string) (*models.Balance, error) {
+	v, err := cacher.Get([]byte(key))
+	if err == cache.ErrorNotFound || err == nil && len(v) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var b models.Balance
+	if err := json.Unmarshal(v, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
@@ -1,14 +1,13 @@
 package webserver
 
 import (
-	"time"
-
 	"github.com/c12o16h1/shender/pkg/cache"
 	"github.com/c12o16h1/shender/pkg/models"
 )
 
-const ENQUEUE_EXPIRY_TIME = 24 * time.Hour
-
-func enqueue(cacher cache.Cacher, url string) error {
-	return cacher.Setex([]byte(models.PREFIX_ENQUEUE+url), ENQUEUE_EXPIRY_TIME, nil)
+// Enqueue page by cache key, so device it should be rendered for is kept.
+// Page which is already enqueued or rendered isn't enqueued again.
+func enqueue(tracker *cache.Tracker, key string, priority models.Priority) error {
+	_, err := tracker.Enqueue(key, priority)
+	return err
 }
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/c12o16h1/shender/pkg/cache"
+	"github.com/c12o16h1/shender/pkg/models"
 	"github.com/pkg/errors"
 )
 
@@ -20,25 +21,34 @@ var (
 	maxExtensionLengt = 4      // Max length of file extension
 	html              = "html" // file extension for html files
 	dotByte           = "."[0] // byte for dot
+
+	// Parts of user agent of mobile bots, f.e. Googlebot Smartphone
+	mobileUserAgents = []string{"Mobile", "Android", "iPhone"}
 )
 
-func PickHandler(cacher cache.Cacher, fs http.Handler) http.Handler {
+func PickHandler(cacher cache.Cacher, tracker *cache.Tracker, fs http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// If request fits requirements - process them with cache handler
 		if verifiedRequest(r) {
 			// Only if we have something in cache - show it and return
 			body, err := isCached(cacher, r)
 			if err != nil {
-				// Spawn goroutine to enqueue crawling
-				go func(cacher cache.Cacher, url string) {
-					if err := enqueue(cacher, url); err != nil {
-						log.Print("can't enqueue url: ", url)
+				// Spawn goroutine to enqueue crawling, bot is waiting for this page, so it's urgent
+				go func(tracker *cache.Tracker, key string) {
+					if err := enqueue(tracker, key, models.PriorityNew); err != nil {
+						log.Print("can't enqueue url: ", key)
 					}
-				}(cacher, urlFromRequest(r))
+				}(tracker, cacheKeyFromRequest(r))
 				// Process with file handler
 				fs.ServeHTTP(w, r)
 				return
 			}
+			// Old page is rendered again in background, it's served meanwhile
+			go func(tracker *cache.Tracker, key string) {
+				if _, err := tracker.Refresh(key); err != nil {
+					log.Print("can't refresh url: ", key)
+				}
+			}(tracker, cacheKeyFromRequest(r))
 			// Show cached content
 			w.Write(body)
 			return
@@ -57,7 +67,7 @@ func verifiedRequest(r *http.Request) bool {
 }
 
 func isCached(cacher cache.Cacher, r *http.Request) ([]byte, error,) {
-	body, err := cacher.Get([]byte(urlFromRequest(r)))
+	body, err := cacher.Get([]byte(cacheKeyFromRequest(r)))
 	if err != nil || len(body) == 0 {
 		return nil, errors.Wrap(err, ERR_NOT_CACHED)
 	}
@@ -114,3 +124,19 @@ func isFile(r *http.Request) bool {
 func urlFromRequest(r *http.Request) string {
 	return r.Host + r.RequestURI
 }
+
+// Mobile and desktop bots get own renders of same page
+func cacheKeyFromRequest(r *http.Request) string {
+	return models.CacheKey(urlFromRequest(r), deviceFromRequest(r))
+}
+
+// Pick device profile by bot user agent
+func deviceFromRequest(r *http.Request) string {
+	ua := r.UserAgent()
+	for _, m := range mobileUserAgents {
+		if strings.Contains(ua, m) {
+			return models.DEVICE_MOBILE
+		}
+	}
+	return models.DEVICE_DESKTOP
+}
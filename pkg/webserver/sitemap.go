@@ -0,0 +1,62 @@
+package webserver
+
+import (
+	"encoding/xml"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/c12o16h1/shender/pkg/cache"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	SITEMAP_WARM_PERIOD = 24 * time.Hour // How often pages from sitemap are checked
+)
+
+// Devices pages from sitemap are rendered for, same as bots are told apart by
+var warmDevices = []string{models.DEVICE_DESKTOP, models.DEVICE_MOBILE}
+
+type sitemap struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+}
+
+// Warm enqueues pages from sitemap file which aren't cached yet, so they're rendered
+// in background before bots ask for them. Returns amount of enqueued pages.
+func Warm(cacher cache.Cacher, tracker *cache.Tracker, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "Warm: os.Open:")
+	}
+	defer f.Close()
+	var sm sitemap
+	if err := xml.NewDecoder(f).Decode(&sm); err != nil {
+		return 0, errors.Wrap(err, "Warm: xml.Decode:")
+	}
+	n := 0
+	for _, u := range sm.URLs {
+		loc, err := url.Parse(u.Loc)
+		if err != nil || loc.Host == "" {
+			continue
+		}
+		// Cache keys are made of host and request URI, like for bots
+		for _, device := range warmDevices {
+			key := models.CacheKey(loc.Host+loc.RequestURI(), device)
+			if body, err := cacher.Get([]byte(key)); err == nil && len(body) > 0 {
+				continue
+			}
+			ok, err := tracker.Enqueue(key, models.PriorityWarm)
+			if err != nil {
+				return n, errors.Wrap(err, "Warm:")
+			}
+			if ok {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,36 @@
+package webserver
+
+import (
+	"net/http"
+
+	"github.com/c12o16h1/shender/pkg/cache"
+	"github.com/c12o16h1/shender/pkg/models"
+)
+
+const (
+	PATH_SCREENSHOT = "/_shender/screenshot"
+	PATH_PDF        = "/_shender/pdf"
+
+	CONTENT_TYPE_PNG = "image/png"
+	CONTENT_TYPE_PDF = "application/pdf"
+)
+
+// SnapshotHandler serves screenshot or PDF stored next to cached page.
+// Page is picked by "url" (host and path, as in cache) and optional "device" query params.
+func SnapshotHandler(cacher cache.Cacher, prefix string, contentType string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		url := r.URL.Query().Get("url")
+		if url == "" {
+			http.Error(w, "url is required", http.StatusBadRequest)
+			return
+		}
+		device := r.URL.Query().Get("device")
+		body, err := cacher.Get([]byte(prefix + models.CacheKey(url, device)))
+		if err != nil || len(body) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+	})
+}